@@ -1,7 +1,6 @@
 package main
 
 import (
-	"bytes"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -16,8 +15,17 @@ import (
 	flag "github.com/spf13/pflag"
 )
 
+// Version of the esvm socket protocol
+const protocolVersion = 1
+
 var currentFlagSet *flag.FlagSet
 var conn net.Conn
+var decoder *json.Decoder
+var lastRequestID = 0
+
+// Older esvm versions handle a single unframed request per connection and do not know the hello command
+var legacyProtocol = false
+var legacyConnUsed = false
 
 func handleServiceSubcommand() {
 	if len(os.Args) == 2 {
@@ -42,6 +50,26 @@ func handleServiceSubcommand() {
 			log.Fatalf("Error: %s", err)
 		}
 
+		// Services may take longer than the socket deadline to start or stop, esvm enforces their timeouts
+		if err := conn.SetDeadline(time.Time{}); err != nil {
+			log.Fatalf("Error: failed to clear socket deadline! Error: %s", err)
+		}
+
+		startStopRestartService(subcommand)
+	case "reset-failed":
+		// Setup flags and help
+		currentFlagSet = flag.NewFlagSet(subcommand, flag.ExitOnError)
+		currentFlagSet.BoolP("json", "j", false, "Return output in json format")
+		setupFlagsAndHelp(currentFlagSet, fmt.Sprintf("ectl %s %s <options> <service>", os.Args[1], subcommand), "Reset the failed state of the specified service", os.Args[3:])
+
+		// Dial esvm socket
+		err := dialSocket()
+		if err == nil {
+			defer conn.Close()
+		} else {
+			log.Fatalf("Error: %s", err)
+		}
+
 		startStopRestartService(subcommand)
 	case "enable", "disable":
 		// Setup flags and help
@@ -84,7 +112,7 @@ func handleServiceSubcommand() {
 		// Setup flags and help
 		currentFlagSet = flag.NewFlagSet("reload", flag.ExitOnError)
 		currentFlagSet.BoolP("json", "j", false, "Return output in json format")
-		setupFlagsAndHelp(currentFlagSet, fmt.Sprintf("ectl %s reload <options>", os.Args[1]), "Reload all services", os.Args[3:])
+		setupFlagsAndHelp(currentFlagSet, fmt.Sprintf("ectl %s reload <options> [service]", os.Args[1]), "Reload all services, or the configuration of the specified service", os.Args[3:])
 
 		// Dial esvm socket
 		err := dialSocket()
@@ -94,7 +122,31 @@ func handleServiceSubcommand() {
 			log.Fatalf("Error: %s", err)
 		}
 
-		reloadAllServices()
+		if currentFlagSet.NArg() > 0 {
+			// Services may take longer than the socket deadline to reload, esvm enforces their timeouts
+			if err := conn.SetDeadline(time.Time{}); err != nil {
+				log.Fatalf("Error: failed to clear socket deadline! Error: %s", err)
+			}
+
+			startStopRestartService("reload-service")
+		} else {
+			reloadAllServices()
+		}
+	case "watch":
+		// Setup flags and help
+		currentFlagSet = flag.NewFlagSet("watch", flag.ExitOnError)
+		currentFlagSet.BoolP("json", "j", false, "Return output in json format")
+		setupFlagsAndHelp(currentFlagSet, fmt.Sprintf("ectl %s watch <options> [service]", os.Args[1]), "Print service events as they happen", os.Args[3:])
+
+		// Dial esvm socket
+		err := dialSocket()
+		if err == nil {
+			defer conn.Close()
+		} else {
+			log.Fatalf("Error: %s", err)
+		}
+
+		watchEvents()
 	default:
 		printSvUsage()
 		os.Exit(1)
@@ -126,16 +178,10 @@ func startStopRestartService(subcommand string) {
 		log.Fatalf("Could not encode JSON data! Error: %s\n", err)
 	}
 
-	_, err = conn.Write(jsonData)
+	// Send request and read the response
+	data, err := sendRequest(jsonData)
 	if err != nil {
-		log.Fatalf("Could not write JSON data to socket! Error: %s\n", err)
-	}
-
-	// Read data from the connection.
-	data, err := readAllConn(conn)
-	if err != nil {
-		log.Fatalf("Could not read data from socket! Error: %s\n", err)
-		return
+		log.Fatalf("Could not communicate with socket! Error: %s\n", err)
 	}
 
 	// Print json data if flag is set
@@ -261,16 +307,10 @@ func showServiceStatus() {
 		log.Fatalf("Could not encode JSON data! Error: %s\n", err)
 	}
 
-	_, err = conn.Write(jsonData)
-	if err != nil {
-		log.Fatalf("Could not write JSON data to socket! Error: %s\n", err)
-	}
-
-	// Read data from the connection.
-	data, err := readAllConn(conn)
+	// Send request and read the response
+	data, err := sendRequest(jsonData)
 	if err != nil {
-		log.Fatalf("Could not read data from socket! Error: %s\n", err)
-		return
+		log.Fatalf("Could not communicate with socket! Error: %s\n", err)
 	}
 
 	// Decoode JSON data
@@ -308,6 +348,9 @@ func showServiceStatus() {
 	fmt.Printf("Name: %s\n", currentFlagSet.Arg(0))
 	fmt.Printf("Description: %s\n", serviceDescription)
 	fmt.Printf("State: %s\n", serviceState)
+	if statusText, ok := returnedJsonData["status_text"].(string); ok && statusText != "" {
+		fmt.Printf("Status: %s\n", statusText)
+	}
 	if serviceEnabled {
 		fmt.Printf("Enabled: %t (Stage %d)\n", serviceEnabled, serviceStage)
 	} else {
@@ -316,6 +359,52 @@ func showServiceStatus() {
 	if serviceState == "running" && processID > 0 {
 		fmt.Printf("Process ID: %d\n", processID)
 	}
+	if health, ok := returnedJsonData["health"].(string); ok && health != "" {
+		fmt.Printf("Health: %s\n", health)
+	}
+	if lastKeepalive, ok := returnedJsonData["last_keepalive"].(string); ok && lastKeepalive != "" {
+		fmt.Printf("Last keepalive: %s\n", formatTimestamp(lastKeepalive))
+	}
+	if failedHook, ok := returnedJsonData["failed_hook"].(string); ok && failedHook != "" {
+		fmt.Printf("Failed hook: %s (Exit code %d)\n", failedHook, int(returnedJsonData["hook_exit_code"].(float64)))
+	}
+	if restart, ok := returnedJsonData["restart"].(string); ok && restart != "" {
+		fmt.Printf("Restart: %s (Restarted %d times)\n", restart, int(returnedJsonData["restart_count"].(float64)))
+	}
+	if cgroup, ok := returnedJsonData["cgroup"].(string); ok && cgroup != "" {
+		fmt.Printf("CGroup: %s\n", cgroup)
+	}
+	if processes, ok := returnedJsonData["processes"].([]any); ok && len(processes) > 0 {
+		processStrs := make([]string, 0, len(processes))
+		for _, process := range processes {
+			processStrs = append(processStrs, fmt.Sprintf("%v", process))
+		}
+		fmt.Printf("Processes: %s\n", strings.Join(processStrs, ", "))
+	}
+	if nextElapse, ok := returnedJsonData["next_elapse"].(string); ok && nextElapse != "" {
+		fmt.Printf("Next elapse: %s\n", formatTimestamp(nextElapse))
+	}
+	if lastTriggered, ok := returnedJsonData["last_triggered"].(string); ok && lastTriggered != "" {
+		fmt.Printf("Last triggered: %s\n", formatTimestamp(lastTriggered))
+	}
+	if limits, ok := returnedJsonData["limits"].(map[string]any); ok && len(limits) > 0 {
+		fmt.Printf("Limits: %s\n", joinJsonMap(limits, ", "))
+	}
+	if cgroupLimits, ok := returnedJsonData["cgroup_limits"].(map[string]any); ok && len(cgroupLimits) > 0 {
+		fmt.Printf("CGroup limits: %s\n", joinJsonMap(cgroupLimits, ", "))
+	}
+	if sockets, ok := returnedJsonData["sockets"].([]any); ok && len(sockets) > 0 {
+		fmt.Printf("Sockets: %s\n", joinJsonStrings(sockets, ", "))
+	}
+	if requires, ok := returnedJsonData["requires"].([]any); ok && len(requires) > 0 {
+		fmt.Printf("Requires: %s\n", joinJsonStrings(requires, ", "))
+	}
+	if wants, ok := returnedJsonData["wants"].([]any); ok && len(wants) > 0 {
+		fmt.Printf("Wants: %s\n", joinJsonStrings(wants, ", "))
+	}
+	if requiredBy, ok := returnedJsonData["required_by"].([]any); ok && len(requiredBy) > 0 {
+		fmt.Printf("Required by: %s\n", joinJsonStrings(requiredBy, ", "))
+	}
 }
 
 func listAllServices() {
@@ -335,16 +424,10 @@ func listAllServices() {
 		log.Fatalf("Could not encode JSON data! Error: %s\n", err)
 	}
 
-	_, err = conn.Write(jsonData)
+	// Send request and read the response
+	data, err := sendRequest(jsonData)
 	if err != nil {
-		log.Fatalf("Could not write JSON data to socket! Error: %s\n", err)
-	}
-
-	// Read data from the connection.
-	data, err := readAllConn(conn)
-	if err != nil {
-		log.Fatalf("Could not read data from socket! Error: %s\n", err)
-		return
+		log.Fatalf("Could not communicate with socket! Error: %s\n", err)
 	}
 
 	// Decoode JSON data
@@ -389,6 +472,9 @@ func listAllServices() {
 		if serviceState == "running" && processID > 0 {
 			fmt.Printf("Process ID: %d\n", processID)
 		}
+		if nextElapse, ok := serviceMap.(map[string]any)["next_elapse"].(string); ok && nextElapse != "" {
+			fmt.Printf("Next elapse: %s\n", formatTimestamp(nextElapse))
+		}
 		fmt.Println()
 	}
 }
@@ -411,16 +497,10 @@ func reloadAllServices() {
 		log.Fatalf("Could not encode JSON data! Error: %s\n", err)
 	}
 
-	_, err = conn.Write(jsonData)
+	// Send request and read the response
+	data, err := sendRequest(jsonData)
 	if err != nil {
-		log.Fatalf("Could not write JSON data to socket! Error: %s\n", err)
-	}
-
-	// Read data from the connection.
-	data, err := readAllConn(conn)
-	if err != nil {
-		log.Fatalf("Could not read data from socket! Error: %s\n", err)
-		return
+		log.Fatalf("Could not communicate with socket! Error: %s\n", err)
 	}
 
 	// Print json data if flag is set
@@ -445,6 +525,101 @@ func reloadAllServices() {
 	}
 }
 
+func watchEvents() {
+	// Get flags
+	printJson, _ := currentFlagSet.GetBool("json")
+
+	type ServiceCommandJsonStruct struct {
+		Command string `json:"command"`
+		Service string `json:"service,omitempty"`
+	}
+	serviceCommandJson := ServiceCommandJsonStruct{
+		Command: "subscribe",
+		Service: currentFlagSet.Arg(0),
+	}
+
+	// Encode struct to json string
+	jsonData, err := json.Marshal(serviceCommandJson)
+	if err != nil {
+		log.Fatalf("Could not encode JSON data! Error: %s\n", err)
+	}
+
+	// Send request and read the response
+	data, err := sendRequest(jsonData)
+	if err != nil {
+		log.Fatalf("Could not communicate with socket! Error: %s\n", err)
+	}
+
+	// Decoode JSON data
+	var returnedJsonData map[string]any
+	err = json.Unmarshal(data, &returnedJsonData)
+	if err != nil {
+		log.Fatalf("Could not decode JSON data from connection!")
+	}
+
+	if err, ok := returnedJsonData["error"]; ok {
+		log.Fatal(err)
+	}
+
+	// Events are streamed until esvm closes the connection
+	if err := conn.SetDeadline(time.Time{}); err != nil {
+		log.Fatalf("Could not clear socket deadline! Error: %s\n", err)
+	}
+
+	for {
+		var response map[string]any
+		if err := decoder.Decode(&response); err == io.EOF {
+			return
+		} else if err != nil {
+			log.Fatalf("Could not communicate with socket! Error: %s\n", err)
+		}
+
+		event, ok := response["event"].(map[string]any)
+		if !ok {
+			continue
+		}
+
+		// Print json data if flag is set
+		if printJson {
+			data, _ = json.Marshal(event)
+			fmt.Println(string(data))
+			continue
+		}
+
+		fmt.Println(formatEvent(event))
+	}
+}
+
+// Format an event received from esvm as a human readable line
+func formatEvent(event map[string]any) string {
+	timestamp, _ := event["time"].(string)
+	serviceName, _ := event["service"].(string)
+	prefix := formatTimestamp(timestamp) + ": "
+
+	switch event["type"] {
+	case "service_loaded":
+		return prefix + fmt.Sprintf("Service (%s) has been loaded", serviceName)
+	case "service_reloaded":
+		return prefix + fmt.Sprintf("Service (%s) has been reloaded", serviceName)
+	case "service_removed":
+		return prefix + fmt.Sprintf("Service (%s) has been removed", serviceName)
+	case "state_changed":
+		line := prefix + fmt.Sprintf("Service (%s) changed state from %s to %s", serviceName, event["old_state"], event["new_state"])
+		if exitCode, ok := event["exit_code"].(float64); ok {
+			line += fmt.Sprintf(" (exit code %d)", int(exitCode))
+		}
+		return line
+	case "restart_scheduled":
+		restartDelay, _ := event["restart_delay"].(float64)
+		return prefix + fmt.Sprintf("Service (%s) will be restarted in %s", serviceName, time.Duration(restartDelay)*time.Second)
+	case "stage_reached":
+		stage, _ := event["stage"].(float64)
+		return prefix + fmt.Sprintf("Stage %d has been reached", int(stage))
+	default:
+		return prefix + fmt.Sprintf("Unknown event (%s)", event["type"])
+	}
+}
+
 func printSvUsage() {
 	fmt.Printf("Usage: ectl %s <subcommand> [options] [service]\n", os.Args[1])
 	fmt.Println("Description: Manage system services")
@@ -452,11 +627,13 @@ func printSvUsage() {
 	fmt.Println("  start     Start service")
 	fmt.Println("  stop      Stop service")
 	fmt.Println("  restart   Restart service")
+	fmt.Println("  reset-failed  Reset failed service")
 	fmt.Println("  enable    Enable service")
 	fmt.Println("  disable   Disable service")
 	fmt.Println("  status    Show service status")
 	fmt.Println("  list      List services")
-	fmt.Println("  reload    Reload services")
+	fmt.Println("  reload    Reload services or service configuration")
+	fmt.Println("  watch     Watch service events")
 }
 
 func setupFlagsAndHelp(flagset *flag.FlagSet, usage, desc string, args []string) {
@@ -473,6 +650,39 @@ func setupFlagsAndHelp(flagset *flag.FlagSet, usage, desc string, args []string)
 }
 
 func dialSocket() error {
+	if err := connectSocket(); err != nil {
+		return err
+	}
+
+	// Negotiate protocol version
+	lastRequestID++
+	hello := fmt.Sprintf(`{"command":"hello","id":%d,"protocol_version":%d}`, lastRequestID, protocolVersion)
+	if _, err := conn.Write([]byte(hello + "\n")); err != nil {
+		return fmt.Errorf("could not negotiate protocol version! Error: %s", err)
+	}
+
+	var response map[string]any
+	if err := decoder.Decode(&response); err != nil {
+		return fmt.Errorf("could not negotiate protocol version! Error: %s", err)
+	}
+
+	// Fall back to the legacy protocol if esvm does not frame its response or does not know the hello command. The
+	// connection has been used up by the hello command, so connect again for the first request
+	if _, framed := response["id"]; !framed || response["code"] == "unknown_command" {
+		legacyProtocol = true
+		conn.Close()
+		return connectSocket()
+	}
+
+	if errMsg, ok := response["error"]; ok {
+		return fmt.Errorf("could not negotiate protocol version! Error: %s", errMsg)
+	}
+
+	return nil
+}
+
+// Connect to the esvm socket
+func connectSocket() error {
 	if _, err := os.Stat(path.Join(runstatedir, "esvm/esvm.sock")); err != nil {
 		return fmt.Errorf("could not find socket! Error: %s", err)
 	}
@@ -486,27 +696,65 @@ func dialSocket() error {
 	if err := conn.SetDeadline(time.Now().Add(30 * time.Second)); err != nil {
 		return fmt.Errorf("failed to set socket deadline! Error: %s", err)
 	}
+	decoder = json.NewDecoder(conn)
 
 	return nil
 }
 
-func readAllConn(conn net.Conn) ([]byte, error) {
-	var buf bytes.Buffer
+// Send a request using the legacy protocol, connecting again if the connection has been used already
+func sendLegacyRequest(jsonData []byte) ([]byte, error) {
+	if legacyConnUsed {
+		conn.Close()
+		if err := connectSocket(); err != nil {
+			return nil, err
+		}
+	}
+	legacyConnUsed = true
 
-	for {
-		dataChunk := make([]byte, 1024)
+	if _, err := conn.Write(jsonData); err != nil {
+		return nil, err
+	}
+
+	var response map[string]any
+	if err := decoder.Decode(&response); err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(response)
+}
+
+// Send a request to esvm and wait for its response
+func sendRequest(jsonData []byte) ([]byte, error) {
+	if legacyProtocol {
+		return sendLegacyRequest(jsonData)
+	}
+
+	var request map[string]any
+	if err := json.Unmarshal(jsonData, &request); err != nil {
+		return nil, err
+	}
 
-		n, err := conn.Read(dataChunk)
-		if err != nil && err != io.EOF {
+	lastRequestID++
+	request["id"] = lastRequestID
+	data, err := json.Marshal(request)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := conn.Write(append(data, '\n')); err != nil {
+		return nil, err
+	}
+
+	// Read responses until the response to this request arrives
+	for {
+		var response map[string]any
+		if err := decoder.Decode(&response); err != nil {
 			return nil, err
 		}
 
-		buf.Write(dataChunk[:n])
-
-		if n < 1024 {
-			break
+		if id, ok := response["id"].(float64); ok && int(id) == lastRequestID {
+			delete(response, "id")
+			return json.Marshal(response)
 		}
 	}
-
-	return buf.Bytes(), nil
 }
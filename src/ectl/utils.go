@@ -1,10 +1,13 @@
 package main
 
 import (
+	"fmt"
+	"maps"
 	"os"
 	"path"
 	"slices"
 	"strings"
+	"time"
 
 	"gopkg.in/yaml.v3"
 )
@@ -30,6 +33,13 @@ func serviceExists(service string) bool {
 		}
 	}
 
+	// Check for a template the service can be instantiated from
+	if prefix, instance, ok := strings.Cut(service, "@"); ok && prefix != "" && instance != "" {
+		if _, err := os.Stat(path.Join(sysconfdir, "esvm/services", prefix+"@.esv")); err == nil {
+			return true
+		}
+	}
+
 	return false
 }
 
@@ -110,3 +120,32 @@ func readEnabledServices() (EnabledServices map[int][]string) {
 
 	return EnabledServices
 }
+
+func joinJsonStrings(values []any, sep string) string {
+	strs := make([]string, 0, len(values))
+	for _, value := range values {
+		if str, ok := value.(string); ok {
+			strs = append(strs, str)
+		}
+	}
+
+	return strings.Join(strs, sep)
+}
+
+func joinJsonMap(values map[string]any, sep string) string {
+	strs := make([]string, 0, len(values))
+	for _, key := range slices.Sorted(maps.Keys(values)) {
+		strs = append(strs, fmt.Sprintf("%s=%v", key, values[key]))
+	}
+
+	return strings.Join(strs, sep)
+}
+
+func formatTimestamp(timestamp string) string {
+	t, err := time.Parse(time.RFC3339, timestamp)
+	if err != nil {
+		return timestamp
+	}
+
+	return t.Local().Format(time.UnixDate)
+}
@@ -51,6 +51,8 @@ func main() {
 	mountVirtualFilesystems()
 	// Mount filesystems in fstab
 	mountFilesystems()
+	// Open hardware watchdog
+	initWatchdog()
 	// Run sysctl
 	initSysctl()
 	// Set hostname
@@ -160,6 +162,8 @@ func stopServiceManager() {
 	}
 
 	// Check if service manager has stopped gracefully, otherwise send sigkill on timeout
+	timeout := time.After(300 * time.Second)
+	watchdogTicker := getWatchdogTicker()
 	exited := make(chan bool)
 	go func() {
 		for {
@@ -175,10 +179,12 @@ func stopServiceManager() {
 		case <-exited:
 			fmt.Println("Done.")
 			return
-		case <-time.After(300 * time.Second):
+		case <-timeout:
 			log.Println("Could not stop service manager!")
 			syscall.Kill(serviceManagerPid, syscall.SIGKILL)
 			return
+		case <-watchdogTicker:
+			petWatchdog()
 		default:
 			waitZombieProcesses()
 		}
@@ -269,16 +275,22 @@ func waitZombieProcesses() {
 func catchSignals() {
 	sigc := make(chan os.Signal, 1)
 	signal.Notify(sigc, syscall.SIGUSR1, syscall.SIGTERM, syscall.SIGINT, syscall.SIGCHLD)
+	watchdogTicker := getWatchdogTicker()
 	for {
-		switch <-sigc {
-		case syscall.SIGUSR1:
-			signal.Stop(sigc)
-			shutdownSystem()
-		case syscall.SIGTERM, syscall.SIGINT:
-			signal.Stop(sigc)
-			rebootSystem()
-		case syscall.SIGCHLD:
-			waitZombieProcesses()
+		select {
+		case sig := <-sigc:
+			switch sig {
+			case syscall.SIGUSR1:
+				signal.Stop(sigc)
+				shutdownSystem()
+			case syscall.SIGTERM, syscall.SIGINT:
+				signal.Stop(sigc)
+				rebootSystem()
+			case syscall.SIGCHLD:
+				waitZombieProcesses()
+			}
+		case <-watchdogTicker:
+			petWatchdog()
 		}
 	}
 }
@@ -286,7 +298,10 @@ func catchSignals() {
 func shutdownSystem() {
 	fmt.Println("Shutting down...")
 
+	// The watchdog is pet while waiting for the service manager, which enforces the stop timeouts of services
 	stopServiceManager()
+	armShutdownWatchdog()
+
 	killProcesses()
 	unmountFilesystems()
 	remountRootReadonly()
@@ -305,7 +320,10 @@ func shutdownSystem() {
 func rebootSystem() {
 	fmt.Println("Rebooting...")
 
+	// The watchdog is pet while waiting for the service manager, which enforces the stop timeouts of services
 	stopServiceManager()
+	armShutdownWatchdog()
+
 	killProcesses()
 	unmountFilesystems()
 	remountRootReadonly()
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+const defaultWatchdogDevice = "/dev/watchdog"
+
+type watchdogConfig struct {
+	device          string
+	timeout         int
+	shutdownTimeout int
+}
+
+var watchdog *os.File
+var watchdogTimeout time.Duration
+var watchdogShutdownTimeout int
+
+// Set a watchdog option from the config file or the kernel command line
+func (config *watchdogConfig) set(key, value string) error {
+	switch key {
+	case "device":
+		switch value {
+		case "0", "off", "no", "false":
+			config.device = ""
+		case "1", "on", "yes", "true":
+			config.device = defaultWatchdogDevice
+		default:
+			config.device = value
+		}
+	case "timeout", "shutdown_timeout":
+		seconds, err := strconv.Atoi(value)
+		if err != nil || seconds <= 0 {
+			return fmt.Errorf("invalid %s (%s)", key, value)
+		}
+		if key == "timeout" {
+			config.timeout = seconds
+		} else {
+			config.shutdownTimeout = seconds
+		}
+	default:
+		return fmt.Errorf("unknown option (%s)", key)
+	}
+
+	return nil
+}
+
+// Read the watchdog config file, then apply enit.watchdog, enit.watchdog_timeout and enit.watchdog_shutdown_timeout
+// from the kernel command line
+func readWatchdogConfig() watchdogConfig {
+	// The shutdown timeout only covers the end of the shutdown after the service manager has stopped, so it is shorter
+	// than the runtime timeout and a hanging shutdown is reset quickly
+	config := watchdogConfig{
+		device:          "",
+		timeout:         60,
+		shutdownTimeout: 30,
+	}
+
+	// Read config file
+	if data, err := os.ReadFile(path.Join(sysconfdir, "enit/watchdog.conf")); err == nil {
+		for i, line := range strings.Split(string(data), "\n") {
+			line = strings.TrimSpace(line)
+			if line == "" || strings.HasPrefix(line, "#") {
+				continue
+			}
+
+			key, value, _ := strings.Cut(line, "=")
+			if err := config.set(strings.TrimSpace(key), strings.TrimSpace(value)); err != nil {
+				log.Printf("Warning: could not parse line %d of watchdog config: %s", i+1, err)
+			}
+		}
+	}
+
+	// Read kernel command line
+	if data, err := os.ReadFile("/proc/cmdline"); err == nil {
+		for _, param := range strings.Fields(string(data)) {
+			key, value, _ := strings.Cut(param, "=")
+			key, ok := strings.CutPrefix(key, "enit.watchdog")
+			if !ok {
+				continue
+			}
+
+			if key == "" {
+				key = "device"
+			}
+			if err := config.set(strings.TrimPrefix(key, "_"), value); err != nil {
+				log.Printf("Warning: could not parse kernel parameter (%s): %s", param, err)
+			}
+		}
+	}
+
+	return config
+}
+
+// Open the hardware watchdog device if enabled and set its timeout
+func initWatchdog() {
+	config := readWatchdogConfig()
+	if config.device == "" {
+		return
+	}
+
+	fmt.Print("Opening hardware watchdog... ")
+
+	var err error
+	watchdog, err = os.OpenFile(config.device, os.O_WRONLY|unix.O_CLOEXEC, 0)
+	if err != nil {
+		log.Printf("Could not open watchdog device %s! Error: %s", config.device, err)
+		return
+	}
+
+	// Set timeout. The driver may round it to a supported value
+	timeout, err := setWatchdogTimeout(config.timeout)
+	if err != nil {
+		log.Printf("Could not set watchdog timeout! Error: %s", err)
+		timeout = config.timeout
+	}
+	watchdogTimeout = time.Duration(timeout) * time.Second
+	watchdogShutdownTimeout = config.shutdownTimeout
+
+	petWatchdog()
+
+	fmt.Printf("Done. (Timeout: %ds)\n", timeout)
+}
+
+// Set the watchdog timeout in seconds and return the timeout set by the driver
+func setWatchdogTimeout(seconds int) (int, error) {
+	timeout := int32(seconds)
+	if _, _, errno := unix.Syscall(unix.SYS_IOCTL, watchdog.Fd(), unix.WDIOC_SETTIMEOUT, uintptr(unsafe.Pointer(&timeout))); errno != 0 {
+		return 0, errno
+	}
+
+	return int(timeout), nil
+}
+
+func petWatchdog() {
+	if watchdog == nil {
+		return
+	}
+
+	if _, _, errno := unix.Syscall(unix.SYS_IOCTL, watchdog.Fd(), unix.WDIOC_KEEPALIVE, 0); errno != 0 {
+		log.Printf("Could not pet watchdog! Error: %s", errno)
+	}
+}
+
+// Get a channel that fires whenever the watchdog should be pet. Returns nil if no watchdog is open
+func getWatchdogTicker() <-chan time.Time {
+	if watchdog == nil {
+		return nil
+	}
+
+	return time.NewTicker(watchdogTimeout / 2).C
+}
+
+// Switch the watchdog to the shutdown timeout once the service manager has stopped. It is not pet anymore
+// afterwards, so the system is reset if killing the remaining processes and unmounting takes longer than the timeout
+func armShutdownWatchdog() {
+	if watchdog == nil {
+		return
+	}
+
+	if _, err := setWatchdogTimeout(watchdogShutdownTimeout); err != nil {
+		log.Printf("Could not set watchdog shutdown timeout! Error: %s", err)
+	}
+	petWatchdog()
+}
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+type EnitServiceSocket struct {
+	Name   string `yaml:"name,omitempty"`
+	Type   string `yaml:"type"`
+	Listen string `yaml:"listen"`
+	Mode   string `yaml:"mode,omitempty"`
+}
+
+type activationSocket struct {
+	config   EnitServiceSocket
+	listener io.Closer
+	file     *os.File
+}
+
+// Check whether the socket definition is valid
+func (socket EnitServiceSocket) validate() error {
+	switch socket.Type {
+	case "unix", "unixgram", "tcp", "udp", "fifo":
+	default:
+		return fmt.Errorf("unknown socket type (%s)", socket.Type)
+	}
+
+	if strings.TrimSpace(socket.Listen) == "" {
+		return fmt.Errorf("socket listen address is empty")
+	}
+
+	if socket.Mode != "" {
+		if _, err := strconv.ParseUint(socket.Mode, 8, 32); err != nil {
+			return fmt.Errorf("invalid socket mode (%s)", socket.Mode)
+		}
+	}
+
+	return nil
+}
+
+// Get the permissions for unix sockets and FIFOs
+func (socket EnitServiceSocket) getMode() os.FileMode {
+	if socket.Mode == "" {
+		return 0666
+	}
+
+	mode, _ := strconv.ParseUint(socket.Mode, 8, 32)
+	return os.FileMode(mode)
+}
+
+// Get the address to listen on. TCP and UDP sockets listen on localhost if only a port is given
+func (socket EnitServiceSocket) getAddress() string {
+	if (socket.Type == "tcp" || socket.Type == "udp") && !strings.Contains(socket.Listen, ":") {
+		return "127.0.0.1:" + socket.Listen
+	}
+
+	return socket.Listen
+}
+
+func openActivationSocket(config EnitServiceSocket) (socket *activationSocket, err error) {
+	socket = &activationSocket{config: config}
+	address := config.getAddress()
+
+	switch config.Type {
+	case "unix":
+		os.Remove(address)
+		var listener *net.UnixListener
+		listener, err = net.ListenUnix("unix", &net.UnixAddr{Name: address, Net: "unix"})
+		if err != nil {
+			return nil, err
+		}
+		socket.listener = listener
+		socket.file, err = listener.File()
+	case "unixgram":
+		os.Remove(address)
+		var conn *net.UnixConn
+		conn, err = net.ListenUnixgram("unixgram", &net.UnixAddr{Name: address, Net: "unixgram"})
+		if err != nil {
+			return nil, err
+		}
+		socket.listener = conn
+		socket.file, err = conn.File()
+	case "tcp":
+		var listener net.Listener
+		listener, err = net.Listen("tcp", address)
+		if err != nil {
+			return nil, err
+		}
+		socket.listener = listener.(*net.TCPListener)
+		socket.file, err = listener.(*net.TCPListener).File()
+	case "udp":
+		var conn net.PacketConn
+		conn, err = net.ListenPacket("udp", address)
+		if err != nil {
+			return nil, err
+		}
+		socket.listener = conn.(*net.UDPConn)
+		socket.file, err = conn.(*net.UDPConn).File()
+	case "fifo":
+		if _, err := os.Stat(address); os.IsNotExist(err) {
+			if err := syscall.Mkfifo(address, uint32(config.getMode())); err != nil {
+				return nil, err
+			}
+		}
+		var file *os.File
+		file, err = os.OpenFile(address, os.O_RDWR|syscall.O_NONBLOCK, 0)
+		if err != nil {
+			return nil, err
+		}
+		socket.listener = file
+		socket.file = file
+	}
+	if err != nil {
+		socket.close()
+		return nil, err
+	}
+
+	// Set socket file permissions
+	if config.Type == "unix" || config.Type == "unixgram" || config.Type == "fifo" {
+		if err := os.Chmod(address, config.getMode()); err != nil {
+			socket.close()
+			return nil, err
+		}
+	}
+
+	return socket, nil
+}
+
+// Set the read deadline of the socket. Used to wake up goroutines waiting for incoming connections
+func (socket *activationSocket) setReadDeadline(t time.Time) {
+	socket.file.SetReadDeadline(t)
+}
+
+// Wait until the socket has an incoming connection or data to read without consuming it
+func (socket *activationSocket) waitReadable() error {
+	rawConn, err := socket.file.SyscallConn()
+	if err != nil {
+		return err
+	}
+
+	return rawConn.Read(func(fd uintptr) bool {
+		n, err := unix.Poll([]unix.PollFd{{Fd: int32(fd), Events: unix.POLLIN}}, 0)
+		return err == nil && n > 0
+	})
+}
+
+func (socket *activationSocket) close() {
+	if socket.file != nil && socket.file != socket.listener {
+		socket.file.Close()
+	}
+	if socket.listener != nil {
+		socket.listener.Close()
+	}
+	if socket.config.Type == "fifo" {
+		os.Remove(socket.config.getAddress())
+	}
+}
+
+// Open all activation sockets of the service and wait for incoming connections
+func (service *EnitService) listenOnSockets() error {
+	logger.Printf("Listening on sockets for service (%s)...\n", service.Name)
+
+	sockets := make([]*activationSocket, 0, len(service.Sockets))
+	for _, config := range service.Sockets {
+		socket, err := openActivationSocket(config)
+		if err != nil {
+			for _, socket := range sockets {
+				socket.close()
+			}
+			return fmt.Errorf("could not open %s socket (%s): %s", config.Type, config.Listen, err)
+		}
+		sockets = append(sockets, socket)
+	}
+	service.activationSockets = sockets
+
+	service.armSockets()
+
+	// Add to started services order slice
+	addToStartedServicesOrder(service.Name)
+
+	logger.Printf("Service (%s) is waiting for incoming connections!\n", service.Name)
+
+	return nil
+}
+
+// Start the service once any of its activation sockets receives a connection
+func (service *EnitService) armSockets() {
+	service.setState(EnitServiceListening)
+
+	var once sync.Once
+	for _, socket := range service.activationSockets {
+		socket.setReadDeadline(time.Time{})
+		go func() {
+			if err := socket.waitReadable(); err != nil {
+				return
+			}
+
+			once.Do(func() {
+				// Wake up the remaining goroutines
+				for _, socket := range service.activationSockets {
+					socket.setReadDeadline(time.Now())
+				}
+
+				logger.Printf("Activating service (%s) on incoming connection...\n", service.Name)
+				if err := service.StartService(); err != nil {
+					logger.Printf("Error: could not start service (%s): %s", service.Name, err)
+				}
+			})
+		}()
+	}
+}
+
+// Close all activation sockets of the service
+func (service *EnitService) closeSockets() {
+	for _, socket := range service.activationSockets {
+		socket.close()
+	}
+	service.activationSockets = nil
+}
+
+// Get the files and environment variables used to pass activation sockets to the service
+func (service *EnitService) getSocketFiles() (files []*os.File, env []string, err error) {
+	names := make([]string, 0, len(service.activationSockets))
+	for _, socket := range service.activationSockets {
+		// Pass sockets in blocking mode
+		rawConn, err := socket.file.SyscallConn()
+		if err != nil {
+			return nil, nil, err
+		}
+		rawConn.Control(func(fd uintptr) {
+			err = syscall.SetNonblock(int(fd), false)
+		})
+		if err != nil {
+			return nil, nil, err
+		}
+
+		name := socket.config.Name
+		if name == "" {
+			name = service.Name
+		}
+
+		files = append(files, socket.file)
+		names = append(names, name)
+	}
+
+	env = []string{
+		"LISTEN_FDS=" + strconv.Itoa(len(files)),
+		"LISTEN_FDNAMES=" + strings.Join(names, ":"),
+	}
+
+	return files, env, nil
+}
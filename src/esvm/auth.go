@@ -0,0 +1,134 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"os/user"
+	"path"
+	"slices"
+	"strconv"
+
+	"golang.org/x/sys/unix"
+	"gopkg.in/yaml.v3"
+)
+
+// Commands every client may run regardless of the socket policy
+var unrestrictedCommands = []string{"hello"}
+
+type socketPolicy struct {
+	// Commands members of each group are allowed to run
+	Groups map[string][]string `yaml:"groups"`
+	// Commands all users are allowed to run
+	Default []string `yaml:"default"`
+}
+
+var policy = defaultSocketPolicy()
+
+func defaultSocketPolicy() socketPolicy {
+	return socketPolicy{
+		Groups: map[string][]string{
+			"wheel": {"start", "stop", "restart", "reload-service", "reset-failed", "subscribe"},
+		},
+		// Subscriptions hold a connection and an event buffer open, so unprivileged users cannot open them by default
+		Default: []string{"status", "list"},
+	}
+}
+
+// Read the socket policy file. Root is always allowed to run all commands
+func readSocketPolicy() socketPolicy {
+	newPolicy := defaultSocketPolicy()
+
+	data, err := os.ReadFile(path.Join(serviceConfigDir, "socket-policy.yml"))
+	if os.IsNotExist(err) {
+		return newPolicy
+	} else if err != nil {
+		logger.Printf("Error: could not read socket policy file: %s", err)
+		return newPolicy
+	}
+
+	if err := yaml.Unmarshal(data, &newPolicy); err != nil {
+		logger.Printf("Error: could not read socket policy file: %s", err)
+		return defaultSocketPolicy()
+	}
+
+	return newPolicy
+}
+
+// Credentials of the process on the other end of a socket connection
+type peerCredentials struct {
+	pid      int
+	uid      int
+	username string
+	groups   []string
+}
+
+// Get the credentials of the peer process of a unix socket connection
+func getPeerCredentials(conn net.Conn) (*peerCredentials, error) {
+	unixConn, ok := conn.(*net.UnixConn)
+	if !ok {
+		return nil, fmt.Errorf("connection is not a unix socket connection")
+	}
+
+	rawConn, err := unixConn.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+
+	var ucred *unix.Ucred
+	var ucredErr error
+	err = rawConn.Control(func(fd uintptr) {
+		ucred, ucredErr = unix.GetsockoptUcred(int(fd), unix.SOL_SOCKET, unix.SO_PEERCRED)
+	})
+	if err != nil {
+		return nil, err
+	} else if ucredErr != nil {
+		return nil, ucredErr
+	}
+
+	peer := &peerCredentials{
+		pid:      int(ucred.Pid),
+		uid:      int(ucred.Uid),
+		username: strconv.Itoa(int(ucred.Uid)),
+		groups:   make([]string, 0),
+	}
+
+	// Get names of the groups the user is a member of
+	gids := []string{strconv.Itoa(int(ucred.Gid))}
+	if u, err := user.LookupId(strconv.Itoa(int(ucred.Uid))); err == nil {
+		peer.username = u.Username
+		if groupIds, err := u.GroupIds(); err == nil {
+			gids = append(gids, groupIds...)
+		}
+	}
+	for _, gid := range gids {
+		if group, err := user.LookupGroupId(gid); err == nil && !slices.Contains(peer.groups, group.Name) {
+			peer.groups = append(peer.groups, group.Name)
+		}
+	}
+
+	return peer, nil
+}
+
+// Check whether the peer is allowed to run a command. Denials are logged
+func (peer *peerCredentials) isAllowed(command string) bool {
+	if peer.uid == 0 || slices.Contains(unrestrictedCommands, command) {
+		return true
+	}
+
+	allowed := func(commands []string) bool {
+		return slices.Contains(commands, command) || slices.Contains(commands, "*")
+	}
+
+	if allowed(policy.Default) {
+		return true
+	}
+	for _, group := range peer.groups {
+		if allowed(policy.Groups[group]) {
+			return true
+		}
+	}
+
+	logger.Printf("Warning: denied command (%s) from user %s (uid %d, pid %d)\n", command, peer.username, peer.uid, peer.pid)
+	return false
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type calendarSpec struct {
+	weekdays []int
+	years    []int
+	months   []int
+	days     []int
+	hours    []int
+	minutes  []int
+	seconds  []int
+}
+
+var calendarShorthands = map[string]string{
+	"minutely": "*-*-* *:*:00",
+	"hourly":   "*-*-* *:00:00",
+	"daily":    "*-*-* 00:00:00",
+	"weekly":   "Mon *-*-* 00:00:00",
+	"monthly":  "*-*-01 00:00:00",
+	"yearly":   "*-01-01 00:00:00",
+	"annually": "*-01-01 00:00:00",
+}
+
+var weekdayNames = map[string]int{
+	"sun": 0, "sunday": 0,
+	"mon": 1, "monday": 1,
+	"tue": 2, "tuesday": 2,
+	"wed": 3, "wednesday": 3,
+	"thu": 4, "thursday": 4,
+	"fri": 5, "friday": 5,
+	"sat": 6, "saturday": 6,
+}
+
+// Parse a calendar expression in the format "[weekdays] [year-month-day] [hour:minute[:second]]"
+func parseCalendarSpec(expression string) (*calendarSpec, error) {
+	expression = strings.TrimSpace(strings.ToLower(expression))
+	if shorthand, ok := calendarShorthands[expression]; ok {
+		expression = strings.ToLower(shorthand)
+	}
+
+	fields := strings.Fields(expression)
+	if len(fields) == 0 {
+		return nil, fmt.Errorf("calendar expression is empty")
+	}
+
+	spec := &calendarSpec{}
+	weekdayField, dateField, timeField := "*", "*-*-*", "00:00:00"
+
+	// Get weekday field
+	if strings.ContainsAny(fields[0][:1], "abcdefghijklmnopqrstuvwxyz") {
+		weekdayField = fields[0]
+		fields = fields[1:]
+	}
+
+	// Get date and time fields
+	for _, field := range fields {
+		if strings.Contains(field, ":") {
+			timeField = field
+		} else if strings.Contains(field, "-") {
+			dateField = field
+		} else {
+			return nil, fmt.Errorf("invalid calendar field (%s)", field)
+		}
+	}
+
+	var err error
+
+	// Parse weekdays
+	if weekdayField == "*" {
+		spec.weekdays = makeRange(0, 6, 1)
+	} else {
+		for _, part := range strings.Split(weekdayField, ",") {
+			start, end, isRange := strings.Cut(part, "..")
+			startDay, ok := weekdayNames[start]
+			if !ok {
+				return nil, fmt.Errorf("invalid weekday (%s)", start)
+			}
+			if !isRange {
+				spec.weekdays = append(spec.weekdays, startDay)
+				continue
+			}
+			endDay, ok := weekdayNames[end]
+			if !ok {
+				return nil, fmt.Errorf("invalid weekday (%s)", end)
+			}
+			for day := startDay; day != endDay; day = (day + 1) % 7 {
+				spec.weekdays = append(spec.weekdays, day)
+			}
+			spec.weekdays = append(spec.weekdays, endDay)
+		}
+	}
+
+	// Parse date
+	dateParts := strings.Split(dateField, "-")
+	if len(dateParts) == 2 {
+		dateParts = append([]string{"*"}, dateParts...)
+	} else if len(dateParts) != 3 {
+		return nil, fmt.Errorf("invalid date (%s)", dateField)
+	}
+	if spec.years, err = parseCalendarComponent(dateParts[0], 1970, 2199); err != nil {
+		return nil, err
+	}
+	if spec.months, err = parseCalendarComponent(dateParts[1], 1, 12); err != nil {
+		return nil, err
+	}
+	if spec.days, err = parseCalendarComponent(dateParts[2], 1, 31); err != nil {
+		return nil, err
+	}
+
+	// Parse time
+	timeParts := strings.Split(timeField, ":")
+	if len(timeParts) == 2 {
+		timeParts = append(timeParts, "00")
+	} else if len(timeParts) != 3 {
+		return nil, fmt.Errorf("invalid time (%s)", timeField)
+	}
+	if spec.hours, err = parseCalendarComponent(timeParts[0], 0, 23); err != nil {
+		return nil, err
+	}
+	if spec.minutes, err = parseCalendarComponent(timeParts[1], 0, 59); err != nil {
+		return nil, err
+	}
+	if spec.seconds, err = parseCalendarComponent(timeParts[2], 0, 59); err != nil {
+		return nil, err
+	}
+
+	return spec, nil
+}
+
+// Parse a comma separated list of values, ranges (a..b) and repetitions (a/step) into a sorted slice of values
+func parseCalendarComponent(component string, min, max int) ([]int, error) {
+	values := make([]int, 0)
+
+	for _, part := range strings.Split(component, ",") {
+		start, end, step := min, max, 1
+
+		// Get repetition step
+		if before, after, ok := strings.Cut(part, "/"); ok {
+			s, err := strconv.Atoi(after)
+			if err != nil || s <= 0 {
+				return nil, fmt.Errorf("invalid repetition (%s)", part)
+			}
+			step = s
+			part = before
+		}
+
+		if part != "*" {
+			before, after, isRange := strings.Cut(part, "..")
+			s, err := strconv.Atoi(before)
+			if err != nil || s < min || s > max {
+				return nil, fmt.Errorf("invalid value (%s)", part)
+			}
+			start = s
+
+			if isRange {
+				e, err := strconv.Atoi(after)
+				if err != nil || e < start || e > max {
+					return nil, fmt.Errorf("invalid range (%s)", part)
+				}
+				end = e
+			} else if step == 1 {
+				end = start
+			}
+		}
+
+		values = append(values, makeRange(start, end, step)...)
+	}
+
+	slices.Sort(values)
+	return slices.Compact(values), nil
+}
+
+func makeRange(start, end, step int) []int {
+	values := make([]int, 0)
+	for i := start; i <= end; i += step {
+		values = append(values, i)
+	}
+
+	return values
+}
+
+// Get the first time after the given time matching the calendar expression. Returns a zero time if there is none
+func (spec *calendarSpec) next(from time.Time) time.Time {
+	t := from.Truncate(time.Second).Add(time.Second)
+	location := t.Location()
+
+	for t.Year() <= spec.years[len(spec.years)-1] {
+		year, month, day := t.Date()
+		hour, minute, second := t.Clock()
+
+		switch {
+		case !slices.Contains(spec.years, year):
+			t = time.Date(year+1, 1, 1, 0, 0, 0, 0, location)
+		case !slices.Contains(spec.months, int(month)):
+			t = time.Date(year, month+1, 1, 0, 0, 0, 0, location)
+		case !slices.Contains(spec.days, day) || !slices.Contains(spec.weekdays, int(t.Weekday())):
+			t = time.Date(year, month, day+1, 0, 0, 0, 0, location)
+		case !slices.Contains(spec.hours, hour):
+			t = time.Date(year, month, day, hour+1, 0, 0, 0, location)
+		case !slices.Contains(spec.minutes, minute):
+			t = time.Date(year, month, day, hour, minute+1, 0, 0, location)
+		case !slices.Contains(spec.seconds, second):
+			t = t.Add(time.Second)
+		default:
+			return t
+		}
+	}
+
+	return time.Time{}
+}
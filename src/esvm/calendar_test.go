@@ -0,0 +1,182 @@
+package main
+
+import (
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestParseCalendarComponent(t *testing.T) {
+	tests := []struct {
+		component string
+		min, max  int
+		want      []int
+	}{
+		{"*", 0, 3, []int{0, 1, 2, 3}},
+		{"5", 0, 59, []int{5}},
+		{"1,3,1", 1, 12, []int{1, 3}},
+		{"2..4", 1, 12, []int{2, 3, 4}},
+		{"1..9/3", 1, 12, []int{1, 4, 7}},
+		{"5/20", 0, 59, []int{5, 25, 45}},
+		{"*/6", 0, 23, []int{0, 6, 12, 18}},
+		{"0,30..31", 0, 59, []int{0, 30, 31}},
+	}
+
+	for _, test := range tests {
+		got, err := parseCalendarComponent(test.component, test.min, test.max)
+		if err != nil {
+			t.Errorf("parseCalendarComponent(%q) returned error: %s", test.component, err)
+			continue
+		}
+		if !slices.Equal(got, test.want) {
+			t.Errorf("parseCalendarComponent(%q) = %v, want %v", test.component, got, test.want)
+		}
+	}
+}
+
+func TestParseCalendarSpecInvalid(t *testing.T) {
+	expressions := []string{
+		"",
+		"Funday",
+		"Mon..Funday",
+		"*-13-01",
+		"*-*-32",
+		"*-*-* 24:00",
+		"*-*-* 10:60",
+		"*-*-* *:*/0",
+		"*-*-* 10..5:00",
+		"1-2-3-4",
+		"10:00:00:00",
+		"now",
+	}
+
+	for _, expression := range expressions {
+		if _, err := parseCalendarSpec(expression); err == nil {
+			t.Errorf("parseCalendarSpec(%q) did not return an error", expression)
+		}
+	}
+}
+
+func TestParseCalendarSpecWeekdays(t *testing.T) {
+	tests := []struct {
+		expression string
+		want       []int
+	}{
+		{"*-*-*", []int{0, 1, 2, 3, 4, 5, 6}},
+		{"Mon", []int{1}},
+		{"mon,wed,FRIDAY", []int{1, 3, 5}},
+		{"Mon..Fri", []int{1, 2, 3, 4, 5}},
+		{"Fri..Mon", []int{5, 6, 0, 1}},
+		{"Sat..Sun", []int{6, 0}},
+	}
+
+	for _, test := range tests {
+		spec, err := parseCalendarSpec(test.expression)
+		if err != nil {
+			t.Errorf("parseCalendarSpec(%q) returned error: %s", test.expression, err)
+			continue
+		}
+		if !slices.Equal(spec.weekdays, test.want) {
+			t.Errorf("parseCalendarSpec(%q) weekdays = %v, want %v", test.expression, spec.weekdays, test.want)
+		}
+	}
+}
+
+func TestCalendarSpecNext(t *testing.T) {
+	date := func(year int, month time.Month, day, hour, minute, second int) time.Time {
+		return time.Date(year, month, day, hour, minute, second, 0, time.UTC)
+	}
+
+	tests := []struct {
+		expression string
+		from       time.Time
+		want       time.Time
+	}{
+		// Shorthands
+		{"minutely", date(2024, 1, 1, 10, 0, 0), date(2024, 1, 1, 10, 1, 0)},
+		{"hourly", date(2024, 1, 1, 23, 30, 0), date(2024, 1, 2, 0, 0, 0)},
+		{"daily", date(2024, 1, 31, 13, 0, 0), date(2024, 2, 1, 0, 0, 0)},
+		{"weekly", date(2024, 1, 3, 12, 0, 0), date(2024, 1, 8, 0, 0, 0)},
+		{"monthly", date(2024, 1, 15, 0, 0, 0), date(2024, 2, 1, 0, 0, 0)},
+		{"yearly", date(2024, 6, 1, 0, 0, 0), date(2025, 1, 1, 0, 0, 0)},
+		{"annually", date(2024, 12, 31, 23, 59, 59), date(2025, 1, 1, 0, 0, 0)},
+
+		// Matching times are not returned again
+		{"daily", date(2024, 1, 1, 0, 0, 0), date(2024, 1, 2, 0, 0, 0)},
+		{"*-*-* 10:00", date(2024, 1, 1, 9, 59, 59), date(2024, 1, 1, 10, 0, 0)},
+
+		// Weekday ranges
+		{"Mon..Fri 09:00", date(2024, 1, 5, 10, 0, 0), date(2024, 1, 8, 9, 0, 0)},
+		{"Fri..Mon 09:00", date(2024, 1, 2, 10, 0, 0), date(2024, 1, 5, 9, 0, 0)},
+		{"Sat..Sun 09:00", date(2024, 1, 7, 10, 0, 0), date(2024, 1, 13, 9, 0, 0)},
+
+		// Repetitions
+		{"*:0/15", date(2024, 1, 1, 10, 50, 0), date(2024, 1, 1, 11, 0, 0)},
+		{"*:0/15", date(2024, 1, 1, 10, 44, 59), date(2024, 1, 1, 10, 45, 0)},
+		{"*-*-* 0/6:00", date(2024, 1, 1, 19, 0, 0), date(2024, 1, 2, 0, 0, 0)},
+		{"*-*-1/10 00:00", date(2024, 1, 21, 0, 0, 1), date(2024, 1, 31, 0, 0, 0)},
+
+		// Month and year rollover
+		{"*-*-31", date(2024, 2, 1, 0, 0, 0), date(2024, 3, 31, 0, 0, 0)},
+		{"*-*-31", date(2024, 4, 30, 0, 0, 0), date(2024, 5, 31, 0, 0, 0)},
+		{"*-02-29", date(2025, 1, 1, 0, 0, 0), date(2028, 2, 29, 0, 0, 0)},
+		{"*-12-31 23:59:59", date(2024, 12, 31, 23, 59, 59), date(2025, 12, 31, 23, 59, 59)},
+		{"Mon *-*-01", date(2024, 1, 2, 0, 0, 0), date(2024, 4, 1, 0, 0, 0)},
+		{"2030-06-15 12:00", date(2024, 1, 1, 0, 0, 0), date(2030, 6, 15, 12, 0, 0)},
+
+		// Expressions that never match again
+		{"2000-01-01", date(2024, 1, 1, 0, 0, 0), time.Time{}},
+		{"*-02-30", date(2024, 1, 1, 0, 0, 0), time.Time{}},
+	}
+
+	for _, test := range tests {
+		spec, err := parseCalendarSpec(test.expression)
+		if err != nil {
+			t.Errorf("parseCalendarSpec(%q) returned error: %s", test.expression, err)
+			continue
+		}
+		if got := spec.next(test.from); !got.Equal(test.want) {
+			t.Errorf("next(%q, %s) = %s, want %s", test.expression, test.from, got, test.want)
+		}
+	}
+}
+
+func TestCalendarSpecNextDST(t *testing.T) {
+	location, err := time.LoadLocation("Europe/Berlin")
+	if err != nil {
+		t.Skipf("time zone data not available: %s", err)
+	}
+	date := func(year int, month time.Month, day, hour, minute int) time.Time {
+		return time.Date(year, month, day, hour, minute, 0, 0, location)
+	}
+
+	tests := []struct {
+		expression string
+		from       time.Time
+		want       time.Time
+	}{
+		// Times skipped when clocks are turned forward do not match
+		{"*-*-* 02:30", date(2024, 3, 30, 3, 0), date(2024, 4, 1, 2, 30)},
+		{"hourly", date(2024, 3, 31, 1, 30), date(2024, 3, 31, 3, 0)},
+
+		// Times repeated when clocks are turned back only match once
+		{"*-*-* 02:30", date(2024, 10, 26, 3, 0), time.Date(2024, 10, 27, 2, 30, 0, 0, time.FixedZone("CET", 3600))},
+		{"*-*-* 02:30", time.Date(2024, 10, 27, 2, 30, 0, 0, time.FixedZone("CET", 3600)), date(2024, 10, 28, 2, 30)},
+		{"hourly", date(2024, 10, 27, 1, 30), time.Date(2024, 10, 27, 2, 0, 0, 0, time.FixedZone("CET", 3600))},
+	}
+
+	for _, test := range tests {
+		spec, err := parseCalendarSpec(test.expression)
+		if err != nil {
+			t.Errorf("parseCalendarSpec(%q) returned error: %s", test.expression, err)
+			continue
+		}
+		got := spec.next(test.from)
+		if !got.Equal(test.want) {
+			t.Errorf("next(%q, %s) = %s, want %s", test.expression, test.from, got, test.want)
+		}
+		if !got.After(test.from) {
+			t.Errorf("next(%q, %s) = %s is not after the given time", test.expression, test.from, got)
+		}
+	}
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"fmt"
+	"maps"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+var capabilityNames = map[string]int{
+	"CAP_CHOWN":              unix.CAP_CHOWN,
+	"CAP_DAC_OVERRIDE":       unix.CAP_DAC_OVERRIDE,
+	"CAP_DAC_READ_SEARCH":    unix.CAP_DAC_READ_SEARCH,
+	"CAP_FOWNER":             unix.CAP_FOWNER,
+	"CAP_FSETID":             unix.CAP_FSETID,
+	"CAP_KILL":               unix.CAP_KILL,
+	"CAP_SETGID":             unix.CAP_SETGID,
+	"CAP_SETUID":             unix.CAP_SETUID,
+	"CAP_SETPCAP":            unix.CAP_SETPCAP,
+	"CAP_LINUX_IMMUTABLE":    unix.CAP_LINUX_IMMUTABLE,
+	"CAP_NET_BIND_SERVICE":   unix.CAP_NET_BIND_SERVICE,
+	"CAP_NET_BROADCAST":      unix.CAP_NET_BROADCAST,
+	"CAP_NET_ADMIN":          unix.CAP_NET_ADMIN,
+	"CAP_NET_RAW":            unix.CAP_NET_RAW,
+	"CAP_IPC_LOCK":           unix.CAP_IPC_LOCK,
+	"CAP_IPC_OWNER":          unix.CAP_IPC_OWNER,
+	"CAP_SYS_MODULE":         unix.CAP_SYS_MODULE,
+	"CAP_SYS_RAWIO":          unix.CAP_SYS_RAWIO,
+	"CAP_SYS_CHROOT":         unix.CAP_SYS_CHROOT,
+	"CAP_SYS_PTRACE":         unix.CAP_SYS_PTRACE,
+	"CAP_SYS_PACCT":          unix.CAP_SYS_PACCT,
+	"CAP_SYS_ADMIN":          unix.CAP_SYS_ADMIN,
+	"CAP_SYS_BOOT":           unix.CAP_SYS_BOOT,
+	"CAP_SYS_NICE":           unix.CAP_SYS_NICE,
+	"CAP_SYS_RESOURCE":       unix.CAP_SYS_RESOURCE,
+	"CAP_SYS_TIME":           unix.CAP_SYS_TIME,
+	"CAP_SYS_TTY_CONFIG":     unix.CAP_SYS_TTY_CONFIG,
+	"CAP_MKNOD":              unix.CAP_MKNOD,
+	"CAP_LEASE":              unix.CAP_LEASE,
+	"CAP_AUDIT_WRITE":        unix.CAP_AUDIT_WRITE,
+	"CAP_AUDIT_CONTROL":      unix.CAP_AUDIT_CONTROL,
+	"CAP_SETFCAP":            unix.CAP_SETFCAP,
+	"CAP_MAC_OVERRIDE":       unix.CAP_MAC_OVERRIDE,
+	"CAP_MAC_ADMIN":          unix.CAP_MAC_ADMIN,
+	"CAP_SYSLOG":             unix.CAP_SYSLOG,
+	"CAP_WAKE_ALARM":         unix.CAP_WAKE_ALARM,
+	"CAP_BLOCK_SUSPEND":      unix.CAP_BLOCK_SUSPEND,
+	"CAP_AUDIT_READ":         unix.CAP_AUDIT_READ,
+	"CAP_PERFMON":            unix.CAP_PERFMON,
+	"CAP_BPF":                unix.CAP_BPF,
+	"CAP_CHECKPOINT_RESTORE": unix.CAP_CHECKPOINT_RESTORE,
+}
+
+// Parse a list of capability names into a capability mask. The "CAP_" prefix is optional
+func parseCapabilities(capabilities []string) (uint64, error) {
+	mask := uint64(0)
+	for _, name := range capabilities {
+		name = strings.ToUpper(strings.TrimSpace(name))
+		if !strings.HasPrefix(name, "CAP_") {
+			name = "CAP_" + name
+		}
+
+		capability, ok := capabilityNames[name]
+		if !ok {
+			return 0, fmt.Errorf("unknown capability (%s)", name)
+		}
+		mask |= 1 << capability
+	}
+
+	return mask, nil
+}
+
+// Get the names of the capabilities in a capability mask
+func formatCapabilities(mask uint64) []string {
+	names := make([]string, 0)
+	for _, name := range slices.Sorted(maps.Keys(capabilityNames)) {
+		if mask&(1<<capabilityNames[name]) != 0 {
+			names = append(names, name)
+		}
+	}
+
+	return names
+}
+
+// Get the highest capability supported by the running kernel
+func getLastCapability() int {
+	data, err := os.ReadFile("/proc/sys/kernel/cap_last_cap")
+	if err != nil {
+		return unix.CAP_LAST_CAP
+	}
+
+	lastCap, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil {
+		return unix.CAP_LAST_CAP
+	}
+
+	return lastCap
+}
+
+// Drop all capabilities not in the mask from the bounding set of the current process
+func setCapabilityBoundingSet(mask uint64) error {
+	for capability := 0; capability <= getLastCapability(); capability++ {
+		if mask&(1<<capability) != 0 {
+			continue
+		}
+
+		if err := unix.Prctl(unix.PR_CAPBSET_DROP, uintptr(capability), 0, 0, 0); err != nil {
+			return fmt.Errorf("could not drop capability %d: %s", capability, err)
+		}
+	}
+
+	return nil
+}
+
+// Make the capabilities in the mask inheritable and ambient for the current thread so they are kept across exec.
+// If permitted is true the permitted and effective sets are replaced by the mask, which is required after switching
+// to a non-root user
+func setAmbientCapabilities(mask uint64, permitted bool) error {
+	header := unix.CapUserHeader{Version: unix.LINUX_CAPABILITY_VERSION_3}
+	var data [2]unix.CapUserData
+	if err := unix.Capget(&header, &data[0]); err != nil {
+		return err
+	}
+
+	for i := range data {
+		data[i].Inheritable = uint32(mask >> (32 * i))
+		if permitted {
+			data[i].Permitted = uint32(mask >> (32 * i))
+			data[i].Effective = uint32(mask >> (32 * i))
+		}
+	}
+	if err := unix.Capset(&header, &data[0]); err != nil {
+		return err
+	}
+
+	for capability := 0; capability < 64; capability++ {
+		if mask&(1<<capability) == 0 {
+			continue
+		}
+
+		if err := unix.Prctl(unix.PR_CAP_AMBIENT, unix.PR_CAP_AMBIENT_RAISE, uintptr(capability), 0, 0); err != nil {
+			return fmt.Errorf("could not raise ambient capability %d: %s", capability, err)
+		}
+	}
+
+	return nil
+}
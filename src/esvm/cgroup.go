@@ -0,0 +1,375 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"os"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+const cgroupRoot = "/sys/fs/cgroup"
+
+var cgroupsEnabled = false
+var cgroupControllers = []string{"cpu", "io", "memory", "pids"}
+
+// Arguments of the clone3 system call up to the cgroup field added in Linux 5.7
+type cloneArgs struct {
+	flags, pidfd, childTID, parentTID, exitSignal, stack, stackSize, tls, setTID, setTIDSize, cgroup uint64
+}
+
+// Check once whether processes can be started directly in a cgroup. This requires clone3 with CLONE_INTO_CGROUP
+var cloneIntoCgroupSupported = sync.OnceValue(func() bool {
+	file, err := os.Open("/dev/null")
+	if err != nil {
+		return false
+	}
+	defer file.Close()
+
+	// Passing a file that is not a cgroup fails with EBADF if CLONE_INTO_CGROUP is supported. Older kernels fail with
+	// ENOSYS or EINVAL instead, so no process is ever created
+	args := cloneArgs{flags: unix.CLONE_INTO_CGROUP, cgroup: uint64(file.Fd())}
+	_, _, errno := unix.Syscall(unix.SYS_CLONE3, uintptr(unsafe.Pointer(&args)), unsafe.Sizeof(args), 0)
+	return errno == unix.EBADF
+})
+
+// Create the esvm cgroup if cgroup v2 is available
+func initCgroups() {
+	if _, err := os.Stat(path.Join(cgroupRoot, "cgroup.controllers")); err != nil {
+		logger.Println("Warning: cgroup v2 is not available, falling back to process groups for process tracking")
+		return
+	}
+
+	if err := os.MkdirAll(path.Join(cgroupRoot, "esvm"), 0755); err != nil {
+		logger.Printf("Warning: could not create esvm cgroup: %s\n", err)
+		return
+	}
+
+	cgroupsEnabled = true
+
+	// Enable resource controllers for service cgroups
+	for _, cgroupPath := range []string{cgroupRoot, path.Join(cgroupRoot, "esvm")} {
+		if err := enableCgroupControllers(cgroupPath, cgroupControllers); err != nil {
+			logger.Printf("Warning: could not enable cgroup controllers in %s: %s\n", cgroupPath, err)
+		}
+	}
+}
+
+// Get the path of the service cgroup relative to the cgroup root
+func (service *EnitService) getCgroupName() string {
+	return path.Join("/esvm", service.Name)
+}
+
+func (service *EnitService) getCgroupPath() string {
+	return path.Join(cgroupRoot, service.getCgroupName())
+}
+
+// Create the service cgroup and open it. Returns nil if cgroups are not available
+func (service *EnitService) createCgroup() (*os.File, error) {
+	if !cgroupsEnabled {
+		return nil, nil
+	}
+
+	if err := os.MkdirAll(service.getCgroupPath(), 0755); err != nil {
+		return nil, err
+	}
+
+	if err := service.applyCgroupSettings(); err != nil {
+		return nil, err
+	}
+
+	return os.OpenFile(service.getCgroupPath(), os.O_RDONLY|syscall.O_DIRECTORY, 0)
+}
+
+// Move a process into the service cgroup. Used if the process could not be started in the cgroup directly
+func (service *EnitService) addProcessToCgroup(pid int) error {
+	return os.WriteFile(path.Join(service.getCgroupPath(), "cgroup.procs"), []byte(strconv.Itoa(pid)), 0644)
+}
+
+func (service *EnitService) hasCgroup() bool {
+	if !cgroupsEnabled {
+		return false
+	}
+
+	_, err := os.Stat(service.getCgroupPath())
+	return err == nil
+}
+
+// Get the IDs of all processes in the service cgroup
+func (service *EnitService) getCgroupProcesses() []int {
+	data, err := os.ReadFile(path.Join(service.getCgroupPath(), "cgroup.procs"))
+	if err != nil {
+		return make([]int, 0)
+	}
+
+	processes := make([]int, 0)
+	for _, line := range strings.Fields(string(data)) {
+		if pid, err := strconv.Atoi(line); err == nil {
+			processes = append(processes, pid)
+		}
+	}
+
+	return processes
+}
+
+// Check whether the service cgroup has any processes left
+func (service *EnitService) isCgroupPopulated() bool {
+	data, err := os.ReadFile(path.Join(service.getCgroupPath(), "cgroup.events"))
+	if err != nil {
+		return false
+	}
+
+	for _, line := range strings.Split(string(data), "\n") {
+		if key, value, ok := strings.Cut(line, " "); ok && key == "populated" {
+			return value == "1"
+		}
+	}
+
+	return false
+}
+
+// Send a signal to all processes in the service cgroup
+func (service *EnitService) signalCgroup(signal syscall.Signal) {
+	for _, pid := range service.getCgroupProcesses() {
+		syscall.Kill(pid, signal)
+	}
+}
+
+// Kill all processes in the service cgroup
+func (service *EnitService) killCgroup() {
+	err := os.WriteFile(path.Join(service.getCgroupPath(), "cgroup.kill"), []byte("1"), 0644)
+	if errors.Is(err, os.ErrNotExist) {
+		// Fallback for kernels without cgroup.kill
+		service.signalCgroup(syscall.SIGKILL)
+	}
+}
+
+// Kill all remaining processes of the service
+func (service *EnitService) killRemainingProcesses(pid int) {
+	if service.hasCgroup() {
+		service.killCgroup()
+	} else if pid != 0 {
+		syscall.Kill(-pid, syscall.SIGKILL)
+	}
+}
+
+// Wait until the service has no processes left. Returns false on timeout
+func (service *EnitService) waitForExit(pid int, timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		if service.hasCgroup() {
+			if !service.isCgroupPopulated() {
+				return true
+			}
+		} else if err := syscall.Kill(pid, syscall.Signal(0)); err != nil {
+			return true
+		}
+
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	return false
+}
+
+// Remove the service cgroup once all of its processes have exited
+func (service *EnitService) removeCgroup() {
+	if !service.hasCgroup() {
+		return
+	}
+
+	if !service.waitForExit(0, time.Second) {
+		logger.Printf("Warning: could not remove cgroup of service (%s): cgroup is not empty\n", service.Name)
+		return
+	}
+
+	if err := syscall.Rmdir(service.getCgroupPath()); err != nil {
+		logger.Printf("Warning: could not remove cgroup of service (%s): %s\n", service.Name, err)
+	}
+}
+
+// Enable the given controllers for the children of a cgroup, skipping unavailable controllers
+func enableCgroupControllers(cgroupPath string, controllers []string) error {
+	data, err := os.ReadFile(path.Join(cgroupPath, "cgroup.controllers"))
+	if err != nil {
+		return err
+	}
+	available := strings.Fields(string(data))
+
+	toEnable := make([]string, 0)
+	for _, controller := range controllers {
+		if slices.Contains(available, controller) {
+			toEnable = append(toEnable, "+"+controller)
+		}
+	}
+	if len(toEnable) == 0 {
+		return nil
+	}
+
+	return os.WriteFile(path.Join(cgroupPath, "cgroup.subtree_control"), []byte(strings.Join(toEnable, " ")), 0644)
+}
+
+// Parse a memory size in bytes with an optional K, M, G or T suffix. The value "max" is returned as is
+func parseMemorySize(value string) (string, error) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return "", fmt.Errorf("memory size is empty")
+	} else if value == "max" || value == "infinity" {
+		return "max", nil
+	}
+
+	multiplier := uint64(1)
+	switch strings.ToUpper(value[len(value)-1:]) {
+	case "K":
+		multiplier = 1 << 10
+	case "M":
+		multiplier = 1 << 20
+	case "G":
+		multiplier = 1 << 30
+	case "T":
+		multiplier = 1 << 40
+	}
+	if multiplier != 1 {
+		value = value[:len(value)-1]
+	}
+
+	size, err := strconv.ParseUint(value, 10, 64)
+	if err != nil {
+		return "", err
+	}
+
+	return strconv.FormatUint(size*multiplier, 10), nil
+}
+
+// Parse a CPU quota given as a percentage of one CPU, as "max" or as "quota period" in microseconds
+func parseCPUMax(value string) (string, error) {
+	value = strings.TrimSpace(value)
+	if value == "max" || value == "infinity" {
+		return "max", nil
+	}
+
+	if percentage, ok := strings.CutSuffix(value, "%"); ok {
+		p, err := strconv.ParseUint(percentage, 10, 64)
+		if err != nil || p == 0 {
+			return "", fmt.Errorf("invalid percentage (%s)", value)
+		}
+		return strconv.FormatUint(p*1000, 10) + " 100000", nil
+	}
+
+	fields := strings.Fields(value)
+	if len(fields) != 2 {
+		return "", fmt.Errorf("invalid cpu quota (%s)", value)
+	}
+	for _, field := range fields {
+		if _, err := strconv.ParseUint(field, 10, 64); err != nil && field != "max" {
+			return "", fmt.Errorf("invalid cpu quota (%s)", value)
+		}
+	}
+
+	return value, nil
+}
+
+// Get the values to write to the cgroup controller files of the service
+func (service *EnitService) getCgroupSettings() (map[string]string, error) {
+	settings := map[string]string{
+		"memory.max":  "max",
+		"memory.high": "max",
+		"cpu.weight":  "100",
+		"cpu.max":     "max",
+		"io.weight":   "default 100",
+		"pids.max":    "max",
+	}
+
+	var err error
+	if service.MemoryMax != "" {
+		if settings["memory.max"], err = parseMemorySize(service.MemoryMax); err != nil {
+			return nil, fmt.Errorf("invalid memory_max (%s)", service.MemoryMax)
+		}
+	}
+	if service.MemoryHigh != "" {
+		if settings["memory.high"], err = parseMemorySize(service.MemoryHigh); err != nil {
+			return nil, fmt.Errorf("invalid memory_high (%s)", service.MemoryHigh)
+		}
+	}
+	if service.CPUWeight != 0 {
+		if service.CPUWeight < 1 || service.CPUWeight > 10000 {
+			return nil, fmt.Errorf("cpu_weight must be between 1 and 10000")
+		}
+		settings["cpu.weight"] = strconv.Itoa(service.CPUWeight)
+	}
+	if service.CPUMax != "" {
+		if settings["cpu.max"], err = parseCPUMax(service.CPUMax); err != nil {
+			return nil, err
+		}
+	}
+	if service.IOWeight != 0 {
+		if service.IOWeight < 1 || service.IOWeight > 10000 {
+			return nil, fmt.Errorf("io_weight must be between 1 and 10000")
+		}
+		settings["io.weight"] = "default " + strconv.Itoa(service.IOWeight)
+	}
+	if service.PidsMax != "" {
+		if service.PidsMax == "max" || service.PidsMax == "infinity" {
+			settings["pids.max"] = "max"
+		} else if _, err := strconv.ParseUint(service.PidsMax, 10, 64); err != nil {
+			return nil, fmt.Errorf("invalid pids_max (%s)", service.PidsMax)
+		} else {
+			settings["pids.max"] = service.PidsMax
+		}
+	}
+
+	return settings, nil
+}
+
+// Write the resource limits of the service to its cgroup
+func (service *EnitService) applyCgroupSettings() error {
+	settings, err := service.getCgroupSettings()
+	if err != nil {
+		return err
+	}
+
+	for _, file := range slices.Sorted(maps.Keys(settings)) {
+		err := os.WriteFile(path.Join(service.getCgroupPath(), file), []byte(settings[file]), 0644)
+		if errors.Is(err, os.ErrNotExist) {
+			// Skip controllers that are not enabled
+			continue
+		} else if err != nil {
+			return fmt.Errorf("could not write %s: %s", file, err)
+		}
+	}
+
+	return nil
+}
+
+// Get the cgroup resource limits set in the service file
+func (service *EnitService) getConfiguredCgroupLimits() map[string]any {
+	limits := make(map[string]any)
+	if service.MemoryMax != "" {
+		limits["memory_max"] = service.MemoryMax
+	}
+	if service.MemoryHigh != "" {
+		limits["memory_high"] = service.MemoryHigh
+	}
+	if service.CPUWeight != 0 {
+		limits["cpu_weight"] = service.CPUWeight
+	}
+	if service.CPUMax != "" {
+		limits["cpu_max"] = service.CPUMax
+	}
+	if service.IOWeight != 0 {
+		limits["io_weight"] = service.IOWeight
+	}
+	if service.PidsMax != "" {
+		limits["pids_max"] = service.PidsMax
+	}
+
+	return limits
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"os"
+	"path"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+type ESVMConfig struct {
+	StageTimeout  int         `yaml:"stage_timeout"`
+	StageTimeouts map[int]int `yaml:"stage_timeouts,omitempty"`
+	WatchServices bool        `yaml:"watch_services,omitempty"`
+}
+
+var config = defaultESVMConfig()
+
+func defaultESVMConfig() ESVMConfig {
+	return ESVMConfig{
+		StageTimeout:  90,
+		StageTimeouts: make(map[int]int),
+	}
+}
+
+func readESVMConfig() ESVMConfig {
+	newConfig := defaultESVMConfig()
+
+	data, err := os.ReadFile(path.Join(serviceConfigDir, "esvm.yml"))
+	if os.IsNotExist(err) {
+		return newConfig
+	} else if err != nil {
+		logger.Printf("Error: could not read ESVM config file: %s", err)
+		return newConfig
+	}
+
+	err = yaml.Unmarshal(data, &newConfig)
+	if err != nil {
+		logger.Printf("Error: could not read ESVM config file: %s", err)
+		return defaultESVMConfig()
+	}
+
+	return newConfig
+}
+
+// Get the time to wait for all services in a stage to start. A duration of 0 means no timeout
+func (config ESVMConfig) getStageTimeout(stage int) time.Duration {
+	if timeout, ok := config.StageTimeouts[stage]; ok {
+		return time.Duration(timeout) * time.Second
+	}
+
+	return time.Duration(config.StageTimeout) * time.Second
+}
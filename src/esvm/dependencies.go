@@ -0,0 +1,208 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// Get the names of all services that must be started before the service
+func (service *EnitService) getOrderingDependencies() []string {
+	dependencies := slices.Concat(service.Requires, service.Wants, service.After)
+
+	// Add services that must be started before this one
+	for _, sv := range getServices() {
+		if slices.Contains(sv.Before, service.Name) {
+			dependencies = append(dependencies, sv.Name)
+		}
+	}
+
+	slices.Sort(dependencies)
+	return slices.Compact(dependencies)
+}
+
+// Get all loaded services that require the service
+func (service *EnitService) getRequiredBy() []*EnitService {
+	requiredBy := make([]*EnitService, 0)
+	for _, sv := range getServices() {
+		if slices.Contains(sv.Requires, service.Name) {
+			requiredBy = append(requiredBy, sv)
+		}
+	}
+
+	return requiredBy
+}
+
+// Map of service names to the names of services that must be started before them
+type dependencyGraph map[string][]string
+
+// Search states of services while looking for dependency cycles
+const (
+	dependencyUnvisited = iota
+	dependencyVisiting
+	dependencyVisited
+)
+
+// Build the ordering dependency graph of all loaded services
+func getDependencyGraph() dependencyGraph {
+	services := getServices()
+
+	// Collect services that must be started before each service once instead of scanning all services per service
+	before := make(map[string][]string)
+	for _, service := range services {
+		for _, name := range service.Before {
+			before[name] = append(before[name], service.Name)
+		}
+	}
+
+	graph := make(dependencyGraph, len(services))
+	for _, service := range services {
+		dependencies := slices.Concat(service.Requires, service.Wants, service.After, before[service.Name])
+		slices.Sort(dependencies)
+		graph[service.Name] = slices.Compact(dependencies)
+	}
+
+	return graph
+}
+
+// Find a dependency cycle reachable from the given service. Services in the visited state have no cycle reachable
+// from them and are not searched again. Returns nil if there are none
+func (graph dependencyGraph) findCycle(serviceName string, states map[string]int, path []string) []string {
+	switch states[serviceName] {
+	case dependencyVisiting:
+		i := slices.Index(path, serviceName)
+		return append(slices.Clone(path[i:]), serviceName)
+	case dependencyVisited:
+		return nil
+	}
+
+	dependencies, ok := graph[serviceName]
+	if !ok {
+		return nil
+	}
+
+	states[serviceName] = dependencyVisiting
+	path = append(path, serviceName)
+	for _, dependency := range dependencies {
+		if cycle := graph.findCycle(dependency, states, path); cycle != nil {
+			return cycle
+		}
+	}
+	states[serviceName] = dependencyVisited
+
+	return nil
+}
+
+// Find a dependency cycle reachable from the given service. Returns nil if there are none
+func findDependencyCycle(serviceName string) []string {
+	return getDependencyGraph().findCycle(serviceName, make(map[string]int), nil)
+}
+
+// Log all dependency cycles between loaded services
+func CheckDependencyCycles() {
+	graph := getDependencyGraph()
+	states := make(map[string]int)
+	reported := make([]string, 0)
+	for _, service := range getServices() {
+		if slices.Contains(reported, service.Name) {
+			continue
+		}
+
+		cycle := graph.findCycle(service.Name, states, nil)
+		if cycle == nil {
+			continue
+		}
+
+		// Services left on the search path may still lead to other cycles, so search them again later
+		for name, state := range states {
+			if state == dependencyVisiting {
+				delete(states, name)
+			}
+		}
+
+		logger.Printf("Error: dependency cycle detected (%s)\n", strings.Join(cycle, " -> "))
+		reported = append(reported, cycle...)
+	}
+}
+
+// Sort service names so that services are placed after their ordering dependencies
+func sortServicesByDependencies(serviceNames []string) []string {
+	graph := getDependencyGraph()
+	sorted := make([]string, 0, len(serviceNames))
+
+	var visit func(name string, path []string)
+	visit = func(name string, path []string) {
+		if slices.Contains(sorted, name) || slices.Contains(path, name) {
+			return
+		}
+
+		for _, dependency := range graph[name] {
+			if slices.Contains(serviceNames, dependency) {
+				visit(dependency, append(path, name))
+			}
+		}
+
+		sorted = append(sorted, name)
+	}
+
+	for _, name := range serviceNames {
+		visit(name, nil)
+	}
+
+	return sorted
+}
+
+// Start all services required or wanted by the service
+func (service *EnitService) startDependencies() error {
+	// Ensure service is not part of a dependency cycle
+	if cycle := findDependencyCycle(service.Name); cycle != nil {
+		return fmt.Errorf("dependency cycle detected (%s)", strings.Join(cycle, " -> "))
+	}
+
+	// Start required services
+	for _, name := range service.Requires {
+		dependency := GetOrInstantiateService(name)
+		if dependency == nil {
+			return fmt.Errorf("required service (%s) not found", name)
+		}
+		if dependency.state == EnitServiceCompleted {
+			continue
+		}
+
+		if err := dependency.StartService(); err != nil {
+			return fmt.Errorf("could not start required service (%s): %s", name, err)
+		}
+	}
+
+	// Start wanted services
+	for _, name := range service.Wants {
+		dependency := GetOrInstantiateService(name)
+		if dependency == nil {
+			logger.Printf("Warning: service (%s) wanted by (%s) not found\n", name, service.Name)
+			continue
+		}
+		if dependency.state == EnitServiceCompleted {
+			continue
+		}
+
+		if err := dependency.StartService(); err != nil {
+			logger.Printf("Warning: could not start service (%s) wanted by (%s): %s\n", name, service.Name, err)
+		}
+	}
+
+	return nil
+}
+
+// Stop all running services that require the service, including services waiting for connections or their timer
+func (service *EnitService) stopDependents() {
+	for _, dependent := range service.getRequiredBy() {
+		if !dependent.isRunning() && dependent.state != EnitServiceListening && dependent.state != EnitServiceWaiting {
+			continue
+		}
+
+		logger.Printf("Stopping service (%s) as it requires (%s)...\n", dependent.Name, service.Name)
+		if err := dependent.StopService(); err != nil {
+			logger.Printf("Error: could not stop service (%s): %s", dependent.Name, err)
+		}
+	}
+}
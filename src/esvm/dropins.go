@@ -0,0 +1,133 @@
+package main
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"maps"
+	"os"
+	"path"
+	"slices"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Get the drop-in files of a service file sorted by name. Drop-ins in the runtime directory override drop-ins with
+// the same name in the service directory, and instance drop-ins are applied after template drop-ins
+func getDropInFiles(filepath, instance string) []string {
+	dirNames := []string{path.Base(filepath) + ".d"}
+	if instance != "" {
+		dirNames = append(dirNames, getInstanceName(filepath, instance)+".esv.d")
+	}
+
+	dropIns := make([]string, 0)
+	for _, dirName := range dirNames {
+		files := make(map[string]string)
+		for _, dir := range []string{path.Join(path.Dir(filepath), dirName), path.Join(runtimeServiceDir, "services", dirName)} {
+			entries, err := os.ReadDir(dir)
+			if err != nil {
+				continue
+			}
+
+			for _, entry := range entries {
+				if !entry.IsDir() && strings.HasSuffix(entry.Name(), ".yml") {
+					files[entry.Name()] = path.Join(dir, entry.Name())
+				}
+			}
+		}
+
+		for _, name := range slices.Sorted(maps.Keys(files)) {
+			dropIns = append(dropIns, files[name])
+		}
+	}
+
+	return dropIns
+}
+
+// Get the checksum of a service file and all of its drop-ins
+func getServiceChecksum(data []byte, dropIns []string) [32]byte {
+	hash := sha256.New()
+	hash.Write(data)
+	for _, dropIn := range dropIns {
+		dropInData, _ := os.ReadFile(dropIn)
+		hash.Write([]byte("\x00" + dropIn + "\x00"))
+		hash.Write(dropInData)
+	}
+
+	var checksum [32]byte
+	copy(checksum[:], hash.Sum(nil))
+	return checksum
+}
+
+// Parse a service file and merge its drop-ins over it key by key. Nested mappings are merged, other values replaced
+func parseServiceFile(data []byte, dropIns []string, instance string) (*yaml.Node, error) {
+	var document yaml.Node
+	if err := yaml.Unmarshal(expandServiceData(data, instance), &document); err != nil {
+		return nil, err
+	}
+	mapping := getDocumentMapping(&document)
+
+	for _, dropIn := range dropIns {
+		dropInData, err := os.ReadFile(dropIn)
+		if err != nil {
+			return nil, err
+		}
+
+		var dropInDocument yaml.Node
+		if err := yaml.Unmarshal(expandServiceData(dropInData, instance), &dropInDocument); err != nil {
+			return nil, fmt.Errorf("could not parse drop-in %s: %s", dropIn, err)
+		}
+		if len(dropInDocument.Content) == 0 {
+			continue
+		} else if dropInDocument.Content[0].Kind != yaml.MappingNode {
+			return nil, fmt.Errorf("drop-in %s is not a mapping", dropIn)
+		}
+
+		mergeYamlMappings(mapping, dropInDocument.Content[0])
+	}
+
+	return &document, nil
+}
+
+func expandServiceData(data []byte, instance string) []byte {
+	if instance == "" {
+		return data
+	}
+
+	return expandTemplate(data, instance)
+}
+
+// Get the top-level mapping of a document, creating it for empty documents
+func getDocumentMapping(document *yaml.Node) *yaml.Node {
+	if len(document.Content) == 0 {
+		document.Kind = yaml.DocumentNode
+		document.Content = []*yaml.Node{{Kind: yaml.MappingNode, Tag: "!!map"}}
+	}
+
+	return document.Content[0]
+}
+
+func mergeYamlMappings(dst, src *yaml.Node) {
+	for i := 0; i+1 < len(src.Content); i += 2 {
+		key, value := src.Content[i], src.Content[i+1]
+
+		found := false
+		for j := 0; j+1 < len(dst.Content); j += 2 {
+			if dst.Content[j].Value != key.Value {
+				continue
+			}
+
+			found = true
+			if dst.Content[j+1].Kind == yaml.MappingNode && value.Kind == yaml.MappingNode {
+				mergeYamlMappings(dst.Content[j+1], value)
+			} else {
+				dst.Content[j+1] = value
+			}
+			break
+		}
+
+		if !found {
+			dst.Content = append(dst.Content, key, value)
+		}
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"os"
+	"path"
+	"reflect"
+	"testing"
+
+	"gopkg.in/yaml.v3"
+)
+
+func TestMergeYamlMappings(t *testing.T) {
+	tests := []struct {
+		base   string
+		dropIn string
+		want   map[string]any
+	}{
+		// Keys are overridden one by one
+		{"name: a\ntype: simple\n", "type: notify\n", map[string]any{"name": "a", "type": "notify"}},
+		{"name: a\n", "restart: always\n", map[string]any{"name": "a", "restart": "always"}},
+
+		// Nested mappings are merged
+		{
+			"environment:\n  A: \"1\"\n  B: \"2\"\n",
+			"environment:\n  B: \"3\"\n  C: \"4\"\n",
+			map[string]any{"environment": map[string]any{"A": "1", "B": "3", "C": "4"}},
+		},
+
+		// Sequences and values of a different kind are replaced
+		{"requires: [a, b]\n", "requires: [c]\n", map[string]any{"requires": []any{"c"}}},
+		{"wants: [a]\n", "wants: []\n", map[string]any{"wants": []any{}}},
+		{"timer:\n  on_calendar: daily\n", "timer: null\n", map[string]any{"timer": nil}},
+		{"limits: none\n", "limits:\n  nofile: \"1024\"\n", map[string]any{"limits": map[string]any{"nofile": "1024"}}},
+
+		// Empty documents
+		{"", "name: a\n", map[string]any{"name": "a"}},
+		{"name: a\n", "{}\n", map[string]any{"name": "a"}},
+	}
+
+	for _, test := range tests {
+		var base, dropIn yaml.Node
+		if err := yaml.Unmarshal([]byte(test.base), &base); err != nil {
+			t.Fatalf("could not parse %q: %s", test.base, err)
+		}
+		if err := yaml.Unmarshal([]byte(test.dropIn), &dropIn); err != nil {
+			t.Fatalf("could not parse %q: %s", test.dropIn, err)
+		}
+
+		mapping := getDocumentMapping(&base)
+		mergeYamlMappings(mapping, dropIn.Content[0])
+
+		got := make(map[string]any)
+		if err := mapping.Decode(&got); err != nil {
+			t.Errorf("merge(%q, %q) could not be decoded: %s", test.base, test.dropIn, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("merge(%q, %q) = %v, want %v", test.base, test.dropIn, got, test.want)
+		}
+	}
+}
+
+func TestParseServiceFileDropIns(t *testing.T) {
+	dir := t.TempDir()
+	dropIns := []string{path.Join(dir, "10-first.yml"), path.Join(dir, "20-second.yml")}
+	if err := os.WriteFile(dropIns[0], []byte("type: notify\nrequires: [b]\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(dropIns[1], []byte("start_cmd: run %i --second\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	document, err := parseServiceFile([]byte("name: a@%i\ntype: simple\nstart_cmd: run %i\nrequires: [a]\n"), dropIns, "x")
+	if err != nil {
+		t.Fatalf("parseServiceFile returned error: %s", err)
+	}
+
+	got := make(map[string]any)
+	if err := document.Decode(&got); err != nil {
+		t.Fatalf("could not decode service file: %s", err)
+	}
+	want := map[string]any{"name": "a@x", "type": "notify", "start_cmd": "run x --second", "requires": []any{"b"}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("parseServiceFile = %v, want %v", got, want)
+	}
+}
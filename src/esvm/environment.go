@@ -0,0 +1,86 @@
+package main
+
+import (
+	"fmt"
+	"maps"
+	"os"
+	"os/user"
+	"slices"
+	"strings"
+)
+
+const defaultPath = "/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin"
+
+// Get the environment variables service commands should run with
+func (service *EnitService) getEnvironment() ([]string, error) {
+	environment := make(map[string]string)
+	environment["PATH"] = defaultPath
+
+	// Set user variables
+	username := service.User
+	if username == "" {
+		username = "root"
+	}
+	if u, err := user.Lookup(username); err == nil {
+		environment["USER"] = u.Username
+		environment["LOGNAME"] = u.Username
+		environment["HOME"] = u.HomeDir
+	}
+
+	// Set variables from service file
+	maps.Copy(environment, service.Environment)
+
+	// Set variables from environment files
+	for _, environmentFile := range service.EnvironmentFiles {
+		optional := strings.HasPrefix(environmentFile, "-")
+		environmentFile = strings.TrimPrefix(environmentFile, "-")
+
+		variables, err := readEnvironmentFile(environmentFile)
+		if os.IsNotExist(err) && optional {
+			continue
+		} else if err != nil {
+			return nil, fmt.Errorf("could not read environment file (%s): %s", environmentFile, err)
+		}
+
+		maps.Copy(environment, variables)
+	}
+
+	env := make([]string, 0, len(environment))
+	for _, key := range slices.Sorted(maps.Keys(environment)) {
+		env = append(env, key+"="+environment[key])
+	}
+
+	return env, nil
+}
+
+// Read KEY=VALUE pairs from an environment file. Empty lines and lines starting with '#' or ';' are ignored
+func readEnvironmentFile(filepath string) (map[string]string, error) {
+	data, err := os.ReadFile(filepath)
+	if err != nil {
+		return nil, err
+	}
+
+	variables := make(map[string]string)
+	for i, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, ";") {
+			continue
+		}
+
+		key, value, ok := strings.Cut(strings.TrimPrefix(line, "export "), "=")
+		key = strings.TrimSpace(key)
+		if !ok || key == "" {
+			return nil, fmt.Errorf("invalid line %d", i+1)
+		}
+
+		// Remove quotes around value
+		value = strings.TrimSpace(value)
+		if len(value) >= 2 && (value[0] == '"' || value[0] == '\'') && value[len(value)-1] == value[0] {
+			value = value[1 : len(value)-1]
+		}
+
+		variables[key] = value
+	}
+
+	return variables, nil
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"os/exec"
+	"sync"
+	"time"
+)
+
+type esvmEvent struct {
+	Type         string `json:"type"`
+	Time         string `json:"time"`
+	Service      string `json:"service,omitempty"`
+	OldState     string `json:"old_state,omitempty"`
+	NewState     string `json:"new_state,omitempty"`
+	ExitCode     *int   `json:"exit_code,omitempty"`
+	RestartDelay int    `json:"restart_delay,omitempty"`
+	Stage        *int   `json:"stage,omitempty"`
+}
+
+// Number of events buffered for each subscriber before it is disconnected
+const subscriberBufferSize = 256
+
+var subscribers = make(map[chan esvmEvent]bool)
+var subscribersMutex sync.Mutex
+
+// Register a new event subscriber
+func subscribe() chan esvmEvent {
+	subscribersMutex.Lock()
+	defer subscribersMutex.Unlock()
+
+	events := make(chan esvmEvent, subscriberBufferSize)
+	subscribers[events] = true
+
+	return events
+}
+
+// Remove an event subscriber and close its channel
+func unsubscribe(events chan esvmEvent) {
+	subscribersMutex.Lock()
+	defer subscribersMutex.Unlock()
+
+	if subscribers[events] {
+		delete(subscribers, events)
+		close(events)
+	}
+}
+
+// Send an event to all subscribers. Subscribers that do not keep up with events are disconnected
+func publishEvent(event esvmEvent) {
+	subscribersMutex.Lock()
+	defer subscribersMutex.Unlock()
+
+	event.Time = time.Now().Format(time.RFC3339)
+	for events := range subscribers {
+		select {
+		case events <- event:
+		default:
+			logger.Println("Warning: event subscriber is not keeping up with events, disconnecting it")
+			delete(subscribers, events)
+			close(events)
+		}
+	}
+}
+
+// Set the state of the service and notify subscribers of the state transition
+func (service *EnitService) setState(state EnitServiceState) {
+	service.updateState(state, nil)
+}
+
+// Set the state of the service after its process has exited and include the exit code of the process in the state
+// transition event. An exit code of -1 means the process was killed by a signal
+func (service *EnitService) setExitState(state EnitServiceState, waitErr error) {
+	exitCode := 0
+	if exitErr, ok := waitErr.(*exec.ExitError); ok {
+		exitCode = exitErr.ExitCode()
+	} else if waitErr != nil {
+		exitCode = -1
+	}
+
+	service.updateState(state, &exitCode)
+}
+
+func (service *EnitService) updateState(state EnitServiceState, exitCode *int) {
+	oldState := service.state
+	service.state = state
+	if oldState == state {
+		return
+	}
+
+	publishEvent(esvmEvent{
+		Type:     "state_changed",
+		Service:  service.Name,
+		OldState: EnitServiceStateNames[oldState],
+		NewState: EnitServiceStateNames[state],
+		ExitCode: exitCode,
+	})
+}
+
+func handleSubscribeCommand(conn net.Conn, jsonData map[string]any) {
+	// Events can only be streamed using the framed protocol
+	framed, ok := conn.(framedConn)
+	if !ok {
+		conn.Write(wrapErrorInJson(newCommandError(errorCodeInvalidRequest, "Command (subscribe) requires the framed protocol")))
+		return
+	}
+
+	// Only send events of a single service if one is given
+	serviceName, _ := jsonData["service"].(string)
+
+	events := subscribe()
+	defer unsubscribe(events)
+	conn.Write(wrapSuccessMsgInJson("Subscribed to ESVM events"))
+
+	// Stream events until the client closes the connection
+	for {
+		select {
+		case event, ok := <-events:
+			if !ok {
+				return
+			}
+			if serviceName != "" && event.Service != serviceName {
+				continue
+			}
+
+			response, _ := json.Marshal(map[string]any{"event": event})
+			if _, err := conn.Write(response); err != nil {
+				return
+			}
+		case <-framed.closed:
+			return
+		}
+	}
+}
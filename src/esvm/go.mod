@@ -2,4 +2,7 @@ module esvm
 
 go 1.23.4
 
-require gopkg.in/yaml.v3 v3.0.1
+require (
+	golang.org/x/sys v0.31.0
+	gopkg.in/yaml.v3 v3.0.1
+)
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"syscall"
+	"time"
+)
+
+type EnitServiceHealthCheck struct {
+	Command          string `yaml:"command,omitempty"`
+	TCP              string `yaml:"tcp,omitempty"`
+	HTTP             string `yaml:"http,omitempty"`
+	Unix             string `yaml:"unix,omitempty"`
+	Interval         int    `yaml:"interval,omitempty"`
+	Timeout          int    `yaml:"timeout,omitempty"`
+	FailureThreshold int    `yaml:"failure_threshold,omitempty"`
+	Restart          bool   `yaml:"restart,omitempty"`
+}
+
+// Check whether the health check definition is valid and set its defaults
+func (check *EnitServiceHealthCheck) validate() error {
+	checkTypes := 0
+	for _, value := range []string{check.Command, check.TCP, check.HTTP, check.Unix} {
+		if strings.TrimSpace(value) != "" {
+			checkTypes++
+		}
+	}
+	if checkTypes != 1 {
+		return fmt.Errorf("health check must have exactly one of command, tcp, http or unix set")
+	}
+
+	if check.HTTP != "" && !strings.HasPrefix(check.HTTP, "http://") && !strings.HasPrefix(check.HTTP, "https://") {
+		return fmt.Errorf("health check url (%s) must start with http:// or https://", check.HTTP)
+	}
+
+	if check.Interval < 0 || check.Timeout < 0 || check.FailureThreshold < 0 {
+		return fmt.Errorf("health check values cannot be negative")
+	}
+	if check.Interval == 0 {
+		check.Interval = 30
+	}
+	if check.Timeout == 0 {
+		check.Timeout = 5
+	}
+	if check.FailureThreshold == 0 {
+		check.FailureThreshold = 3
+	}
+
+	return nil
+}
+
+// Get the address for TCP health checks. A bare port is checked on localhost
+func (check *EnitServiceHealthCheck) getTCPAddress() string {
+	if !strings.Contains(check.TCP, ":") {
+		return "127.0.0.1:" + check.TCP
+	}
+
+	return check.TCP
+}
+
+// Run the health check of the service once
+func (service *EnitService) runHealthCheck() error {
+	check := service.HealthCheck
+	timeout := time.Duration(check.Timeout) * time.Second
+
+	switch {
+	case check.Command != "":
+		cmd, err := service.createCommand(check.Command)
+		if err != nil {
+			return err
+		}
+		cmd.SysProcAttr.Setpgid = true
+		if err := cmd.Start(); err != nil {
+			return err
+		}
+
+		done := make(chan error, 1)
+		go func() { done <- cmd.Wait() }()
+		select {
+		case err := <-done:
+			return err
+		case <-time.After(timeout):
+			syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+			<-done
+			return fmt.Errorf("command timed out")
+		}
+	case check.TCP != "":
+		conn, err := net.DialTimeout("tcp", check.getTCPAddress(), timeout)
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	case check.Unix != "":
+		conn, err := net.DialTimeout("unix", check.Unix, timeout)
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	case check.HTTP != "":
+		client := http.Client{Timeout: timeout}
+		resp, err := client.Get(check.HTTP)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		if resp.StatusCode >= 400 {
+			return fmt.Errorf("server returned status %s", resp.Status)
+		}
+	}
+
+	return nil
+}
+
+// Periodically run the health check of the service while it is running
+func (service *EnitService) startHealthCheck() {
+	if service.HealthCheck == nil || service.healthStopChannel != nil {
+		return
+	}
+
+	stopChannel := make(chan bool)
+	service.healthStopChannel = stopChannel
+	service.healthFailures = 0
+	service.unhealthy = false
+
+	go func() {
+		for {
+			select {
+			case <-stopChannel:
+				return
+			case <-time.After(time.Duration(service.HealthCheck.Interval) * time.Second):
+			}
+
+			// Skip health checks while the service is reloading or stopping
+			if service.state != EnitServiceRunning {
+				continue
+			}
+
+			err := service.runHealthCheck()
+			if err == nil {
+				if service.unhealthy {
+					logger.Printf("Service (%s) is healthy again\n", service.Name)
+				}
+				service.healthFailures = 0
+				service.unhealthy = false
+				continue
+			}
+
+			service.healthFailures++
+			logger.Printf("Warning: health check of service (%s) has failed (%d/%d): %s\n", service.Name, service.healthFailures, service.HealthCheck.FailureThreshold, err)
+
+			if service.healthFailures < service.HealthCheck.FailureThreshold || service.unhealthy {
+				continue
+			}
+
+			logger.Printf("Service (%s) is unhealthy!\n", service.Name)
+			service.unhealthy = true
+
+			// Restart unhealthy service
+			if service.HealthCheck.Restart {
+				go func() {
+					if err := service.RestartService(); err != nil {
+						logger.Printf("Error: could not restart unhealthy service (%s): %s\n", service.Name, err)
+					}
+				}()
+				return
+			}
+		}
+	}()
+}
+
+func (service *EnitService) stopHealthCheck() {
+	if service.healthStopChannel == nil {
+		return
+	}
+
+	close(service.healthStopChannel)
+	service.healthStopChannel = nil
+}
+
+// Get the health of the service. Returns an empty string if the service has no health check
+func (service *EnitService) getHealth() string {
+	if service.HealthCheck == nil || service.healthStopChannel == nil {
+		return ""
+	} else if service.unhealthy {
+		return "unhealthy"
+	}
+
+	return "healthy"
+}
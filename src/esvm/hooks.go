@@ -0,0 +1,57 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+)
+
+// Run the commands of a service hook in order with the service user, environment and log file. Commands prefixed
+// with '-' may fail without failing the hook
+func (service *EnitService) runHooks(hook string, commands []string) error {
+	if len(commands) == 0 {
+		return nil
+	}
+
+	// Append hook output to service log file
+	var logFile *os.File
+	if service.LogOutput {
+		var err error
+		logFile, err = os.OpenFile(path.Join("/var/log/esvm/", service.Name+".log"), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0666)
+		if err != nil {
+			return err
+		}
+		defer logFile.Close()
+	}
+
+	for _, command := range commands {
+		optional := strings.HasPrefix(command, "-")
+		command = strings.TrimPrefix(command, "-")
+
+		cmd, err := service.createCommand(command)
+		if err != nil {
+			return err
+		}
+		if logFile != nil {
+			cmd.Stdout = logFile
+			cmd.Stderr = logFile
+		}
+		if service.processID != 0 {
+			cmd.Env = append(cmd.Env, fmt.Sprintf("MAINPID=%d", service.processID))
+		}
+
+		if err := cmd.Run(); err != nil && !optional {
+			service.failedHook = hook
+			service.hookExitCode = -1
+			if exitErr, ok := err.(*exec.ExitError); ok {
+				service.hookExitCode = exitErr.ExitCode()
+			}
+
+			return fmt.Errorf("%s command (%s) failed: %s", hook, command, err)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"maps"
+	"os"
+	"path"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+const watchDebounceDelay = 500 * time.Millisecond
+
+const watchMask = unix.IN_CREATE | unix.IN_DELETE | unix.IN_CLOSE_WRITE | unix.IN_MOVED_FROM | unix.IN_MOVED_TO
+
+// Watch the service directory and the enabled services file for changes and reload services automatically
+func watchServiceFiles() error {
+	fd, err := unix.InotifyInit1(unix.IN_CLOEXEC)
+	if err != nil {
+		return err
+	}
+
+	servicesDir := path.Join(serviceConfigDir, "services")
+	watches := make(map[int]string)
+	addWatch := func(dir string) {
+		wd, err := unix.InotifyAddWatch(fd, dir, watchMask)
+		if err != nil {
+			logger.Printf("Warning: could not watch directory %s: %s\n", dir, err)
+			return
+		}
+		watches[wd] = dir
+	}
+
+	addWatch(serviceConfigDir)
+	addWatch(servicesDir)
+	if entries, err := os.ReadDir(servicesDir); err == nil {
+		for _, entry := range entries {
+			if entry.IsDir() && strings.HasSuffix(entry.Name(), ".esv.d") {
+				addWatch(path.Join(servicesDir, entry.Name()))
+			}
+		}
+	}
+
+	var mutex sync.Mutex
+	var debounceTimer *time.Timer
+	changedFiles := make(map[string]bool)
+	enabledServices := ReadEnabledServices()
+
+	go func() {
+		buffer := make([]byte, 64*(unix.SizeofInotifyEvent+unix.NAME_MAX+1))
+		for {
+			n, err := unix.Read(fd, buffer)
+			if err != nil {
+				if err == unix.EINTR {
+					continue
+				}
+				logger.Printf("Error: could not read inotify events: %s\n", err)
+				return
+			}
+
+			mutex.Lock()
+			for offset := 0; offset+unix.SizeofInotifyEvent <= n; {
+				event := (*unix.InotifyEvent)(unsafe.Pointer(&buffer[offset]))
+				nameBytes := buffer[offset+unix.SizeofInotifyEvent : offset+unix.SizeofInotifyEvent+int(event.Len)]
+				name := strings.TrimRight(string(nameBytes), "\x00")
+				offset += unix.SizeofInotifyEvent + int(event.Len)
+
+				dir, ok := watches[int(event.Wd)]
+				if !ok || name == "" {
+					continue
+				}
+
+				// Watch new drop-in directories
+				if event.Mask&unix.IN_ISDIR != 0 && event.Mask&(unix.IN_CREATE|unix.IN_MOVED_TO) != 0 && strings.HasSuffix(name, ".esv.d") {
+					addWatch(path.Join(dir, name))
+				}
+
+				// Ignore unrelated files such as editor swap files
+				if dir == serviceConfigDir && name != "enabled-services.yml" {
+					continue
+				} else if dir != serviceConfigDir && !strings.HasSuffix(name, ".esv") && !strings.HasSuffix(name, ".yml") && !strings.HasSuffix(name, ".esv.d") {
+					continue
+				}
+
+				relativePath := strings.TrimPrefix(path.Join(dir, name), serviceConfigDir+"/")
+				changedFiles[relativePath] = true
+			}
+
+			// Wait for writes to settle before reloading
+			if len(changedFiles) > 0 {
+				if debounceTimer != nil {
+					debounceTimer.Stop()
+				}
+				debounceTimer = time.AfterFunc(watchDebounceDelay, func() {
+					mutex.Lock()
+					files := slices.Sorted(maps.Keys(changedFiles))
+					clear(changedFiles)
+					mutex.Unlock()
+
+					logger.Printf("Detected changes in service configuration: %s\n", strings.Join(files, ", "))
+					if slices.Contains(files, "enabled-services.yml") {
+						newEnabledServices := ReadEnabledServices()
+						logEnabledServicesChanges(enabledServices, newEnabledServices)
+						enabledServices = newEnabledServices
+					}
+					if slices.ContainsFunc(files, func(file string) bool { return file != "enabled-services.yml" }) {
+						Reload()
+					}
+				})
+			}
+			mutex.Unlock()
+		}
+	}()
+
+	logger.Printf("Watching %s for changes\n", serviceConfigDir)
+
+	return nil
+}
+
+// Log services that have been enabled, disabled or moved to another stage
+func logEnabledServicesChanges(oldEnabledServices, newEnabledServices map[int][]string) {
+	getStages := func(enabledServices map[int][]string) map[string]int {
+		stages := make(map[string]int)
+		for stage, services := range enabledServices {
+			for _, service := range services {
+				stages[service] = stage
+			}
+		}
+		return stages
+	}
+	oldStages, newStages := getStages(oldEnabledServices), getStages(newEnabledServices)
+
+	for _, service := range slices.Sorted(maps.Keys(newStages)) {
+		if oldStage, ok := oldStages[service]; !ok {
+			logger.Printf("Service (%s) has been enabled in stage %d\n", service, newStages[service])
+		} else if oldStage != newStages[service] {
+			logger.Printf("Service (%s) has been moved from stage %d to stage %d\n", service, oldStage, newStages[service])
+		}
+	}
+	for _, service := range slices.Sorted(maps.Keys(oldStages)) {
+		if _, ok := newStages[service]; !ok {
+			logger.Printf("Service (%s) has been disabled\n", service)
+		}
+	}
+}
@@ -12,6 +12,7 @@ import (
 	"path"
 	"slices"
 	"strings"
+	"sync"
 	"syscall"
 	"time"
 )
@@ -25,7 +26,14 @@ var serviceConfigDir string
 var logger *log.Logger
 var socket net.Listener
 
+var reloadMutex sync.Mutex
+
 func main() {
+	// Run as spawn helper
+	if len(os.Args) == 2 && os.Args[1] == spawnHelperArg {
+		runSpawnHelper()
+	}
+
 	// Parse flags
 	printVersion := flag.Bool("version", false, "print version and exit")
 	flag.Parse()
@@ -64,9 +72,8 @@ func main() {
 		os.Exit(0)
 	}()
 
-	for {
-		listenToSocket()
-	}
+	// Wait for a termination signal
+	select {}
 }
 
 func setupESVMLogger() error {
@@ -115,12 +122,19 @@ func Init() {
 		logger.Fatalf("Error: could not initialize ESVM: %s", err)
 	}
 
+	// Read ESVM configuration
+	config = readESVMConfig()
+
+	// Setup cgroups for process tracking
+	initCgroups()
+
 	socket, err = initSocket()
 	if err != nil {
 		logger.Fatalf("Error: could not initialize ESVM: %s", err)
 	}
 
 	if stat, err := os.Stat(serviceConfigDir); err != nil || !stat.IsDir() {
+		acceptSocketConnections()
 		logger.Println("ESVM initialized successfully!")
 		return
 	}
@@ -134,55 +148,142 @@ func Init() {
 	for _, entry := range dirEntries {
 		if !entry.IsDir() && strings.HasSuffix(entry.Name(), ".esv") {
 			filepath := path.Join(serviceConfigDir, "services", entry.Name())
-			LoadService(filepath)
+			LoadService(filepath, "")
 		}
 	}
 
+	// Check for dependency cycles
+	CheckDependencyCycles()
+
+	// Reload services automatically when their files change
+	if config.WatchServices {
+		if err := watchServiceFiles(); err != nil {
+			logger.Printf("Warning: could not watch service files: %s\n", err)
+		}
+	}
+
+	// Accept socket connections once all service files have been loaded, so clients can follow the startup of
+	// enabled services
+	acceptSocketConnections()
+
 	// Read enabled services
 	EnabledServices := ReadEnabledServices()
 
 	// Start enabled services
 	stages := slices.Collect(maps.Keys(EnabledServices))
 	slices.Sort(stages)
-	for stage := 1; stage <= stages[len(stages)-1]; stage++ {
-		logger.Printf("Starting stage %d services...", stage)
-
-		services := EnabledServices[stage]
-		remainingServices := len(services)
-		for remainingServices != 0 {
-			for _, serviceName := range services {
-				service := GetServiceByName(serviceName)
-				if service == nil {
-					remainingServices--
-					continue
-				}
+	for _, stage := range stages {
+		startStage(stage, EnabledServices[stage])
+	}
+
+	logger.Println("ESVM initialized successfully!")
+}
+
+func startStage(stage int, serviceNames []string) {
+	logger.Printf("Starting stage %d services...", stage)
+
+	// Load instances of templated services before sorting them
+	for _, serviceName := range serviceNames {
+		GetOrInstantiateService(serviceName)
+	}
+	serviceNames = sortServicesByDependencies(serviceNames)
+
+	// Create a channel for each service that is closed once it has started or failed
+	doneChannels := make(map[string]chan bool)
+	for _, serviceName := range serviceNames {
+		doneChannels[serviceName] = make(chan bool)
+	}
+
+	// Start all services in parallel
+	var waitGroup sync.WaitGroup
+	var pendingMutex sync.Mutex
+	pending := slices.Clone(serviceNames)
+	for _, serviceName := range serviceNames {
+		waitGroup.Add(1)
+		go func() {
+			defer waitGroup.Done()
+			defer close(doneChannels[serviceName])
+			defer func() {
+				pendingMutex.Lock()
+				pending = slices.DeleteFunc(pending, func(name string) bool { return name == serviceName })
+				pendingMutex.Unlock()
+			}()
+
+			service := GetServiceByName(serviceName)
+			if service == nil {
+				logger.Printf("Error: could not start service (%s): service not found", serviceName)
+				return
+			}
 
-				err := service.StartService()
-				if err != nil {
-					logger.Printf("Error: could not start service (%s): %s", service.Name, err)
+			// Wait for services in this stage that must be started first. Services that are part of a dependency
+			// cycle would wait for each other forever, so they fail to start right away instead
+			if findDependencyCycle(serviceName) == nil {
+				for _, dependency := range service.getOrderingDependencies() {
+					if doneChannel, ok := doneChannels[dependency]; ok {
+						<-doneChannel
+					}
 				}
-				remainingServices--
 			}
-		}
+
+			err := service.StartService()
+			if err != nil {
+				logger.Printf("Error: could not start service (%s): %s", service.Name, err)
+			}
+		}()
 	}
 
-	logger.Println("ESVM initialized successfully!")
+	// Wait for all services to start or for the stage to time out
+	stageDone := make(chan bool)
+	go func() {
+		waitGroup.Wait()
+		close(stageDone)
+	}()
+
+	// Notify subscribers once the stage has been reached
+	defer publishEvent(esvmEvent{Type: "stage_reached", Stage: &stage})
+
+	timeout := config.getStageTimeout(stage)
+	if timeout <= 0 {
+		<-stageDone
+		return
+	}
+
+	select {
+	case <-stageDone:
+	case <-time.After(timeout):
+		pendingMutex.Lock()
+		logger.Printf("Warning: stage %d timed out after %s while waiting for services (%s)", stage, timeout, strings.Join(pending, ", "))
+		pendingMutex.Unlock()
+	}
 }
 
 func Reload() {
+	// Reloads are requested over the socket and by the service file watcher, only run one at a time
+	reloadMutex.Lock()
+	defer reloadMutex.Unlock()
+
 	logger.Println("Reloading all ESVM services...")
 
 	dirEntries, err := os.ReadDir(path.Join(serviceConfigDir, "services"))
 	if err != nil {
-		logger.Fatalf("Error: Could not initialize ESVM: %s", err)
+		logger.Printf("Error: could not reload ESVM services: %s\n", err)
+		return
 	}
 
 	// Read and load service files
-	servicesToRemove := slices.Clone(Services)
+	servicesToRemove := getServices()
 	for _, entry := range dirEntries {
 		if !entry.IsDir() && strings.HasSuffix(entry.Name(), ".esv") {
 			filepath := path.Join(serviceConfigDir, "services", entry.Name())
-			LoadService(filepath)
+			LoadService(filepath, "")
+
+			// Reload instances of templated services
+			for _, service := range getServices() {
+				if service.Filepath == filepath && service.instance != "" {
+					LoadService(filepath, service.instance)
+				}
+			}
+
 			servicesToRemove = slices.DeleteFunc(servicesToRemove, func(sv *EnitService) bool {
 				return sv.Filepath == filepath
 			})
@@ -191,19 +292,29 @@ func Reload() {
 
 	// Reload services that had their esv file removed
 	for _, service := range servicesToRemove {
-		LoadService(service.Filepath)
+		LoadService(service.Filepath, service.instance)
 	}
 
+	// Check for dependency cycles
+	CheckDependencyCycles()
+
+	// Reload socket policy
+	policy = readSocketPolicy()
+
 	logger.Println("All ESVM services have been reloaded!")
 }
 
 func Destroy() {
 	logger.Println("Stopping all ESVM services...")
 
+	servicesMutex.RLock()
+	servicesOrder := slices.Clone(startedServicesOrder)
+	servicesMutex.RUnlock()
+
 	// Loop through all started services in reverse
-	for i := len(startedServicesOrder) - 1; i >= 0; i-- {
+	for i := len(servicesOrder) - 1; i >= 0; i-- {
 		// Get service by name
-		service := GetServiceByName(startedServicesOrder[i])
+		service := GetServiceByName(servicesOrder[i])
 		if service == nil {
 			continue
 		}
@@ -218,10 +329,11 @@ func Destroy() {
 }
 
 func GetServiceByName(name string) *EnitService {
-	for _, service := range Services {
+	for _, service := range getServices() {
 		if service.Name == name {
 			return service
 		}
 	}
+
 	return nil
 }
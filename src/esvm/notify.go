@@ -0,0 +1,182 @@
+package main
+
+import (
+	"net"
+	"os"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Create a unix datagram socket the service can send sd_notify messages to
+func (service *EnitService) openNotifySocket() (*net.UnixConn, error) {
+	// Create notify socket directory
+	err := os.MkdirAll(path.Join(runtimeServiceDir, "notify"), 0755)
+	if err != nil {
+		return nil, err
+	}
+
+	// Remove leftover socket
+	socketPath := path.Join(runtimeServiceDir, "notify", service.Name+".sock")
+	os.Remove(socketPath)
+
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: socketPath, Net: "unixgram"})
+	if err != nil {
+		return nil, err
+	}
+
+	// Allow the service user to write to the socket
+	if credential, err := service.getCredential(); err != nil {
+		conn.Close()
+		return nil, err
+	} else if credential != nil {
+		err = os.Chown(socketPath, int(credential.Uid), int(credential.Gid))
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+
+	return conn, nil
+}
+
+// Read sd_notify messages from the socket until it is closed. The ready channel is closed once READY=1 is received
+func (service *EnitService) handleNotifyMessages(conn *net.UnixConn, ready chan bool) {
+	buffer := make([]byte, 4096)
+	readyClosed := false
+
+	for {
+		n, _, err := conn.ReadFromUnix(buffer)
+		if err != nil {
+			return
+		}
+
+		for _, line := range strings.Split(string(buffer[:n]), "\n") {
+			key, value, ok := strings.Cut(strings.TrimSpace(line), "=")
+			if !ok {
+				continue
+			}
+
+			switch key {
+			case "READY":
+				if value != "1" {
+					continue
+				}
+				if service.state == EnitServiceReloading {
+					logger.Printf("Service (%s) has finished reloading\n", service.Name)
+					service.setState(EnitServiceRunning)
+				}
+				if !readyClosed {
+					close(ready)
+					readyClosed = true
+				}
+			case "RELOADING":
+				if value == "1" {
+					service.setState(EnitServiceReloading)
+				}
+			case "STOPPING":
+				if value == "1" {
+					service.setState(EnitServiceStopping)
+				}
+			case "STATUS":
+				service.statusText = value
+			case "MAINPID":
+				pid, err := strconv.Atoi(value)
+				if err != nil || pid <= 0 {
+					logger.Printf("Warning: service (%s) sent an invalid MAINPID (%s)\n", service.Name, value)
+					continue
+				}
+				if !service.isServiceProcess(pid) {
+					logger.Printf("Warning: service (%s) sent a MAINPID (%d) that does not belong to the service\n", service.Name, pid)
+					continue
+				}
+				service.processID = pid
+			case "WATCHDOG":
+				if value == "1" {
+					service.lastWatchdogPing = time.Now()
+				}
+			}
+		}
+	}
+}
+
+// Wait until the main process announced with MAINPID has exited. Returns right away if the service did not announce
+// a main process other than the spawned process. The main process is not a child of esvm, so it is polled
+func (service *EnitService) waitForMainProcess() {
+	pid := service.processID
+	if pid == 0 || pid == service.spawnedProcessID {
+		return
+	}
+
+	for isProcessRunning(pid) {
+		time.Sleep(100 * time.Millisecond)
+	}
+	logger.Printf("Main process (%d) of service (%s) has exited\n", pid, service.Name)
+}
+
+// Check whether a process belongs to the service. The process must be in the service cgroup, or a descendant of the
+// spawned process if cgroups are not available
+func (service *EnitService) isServiceProcess(pid int) bool {
+	if pid <= 1 {
+		return false
+	}
+
+	if service.hasCgroup() {
+		return slices.Contains(service.getCgroupProcesses(), pid)
+	}
+
+	for pid > 1 {
+		if pid == service.spawnedProcessID {
+			return true
+		}
+		pid = getParentProcessID(pid)
+	}
+
+	return false
+}
+
+// Get the fields of /proc/<pid>/stat following the process name. Returns nil if the process does not exist
+func getProcessStatFields(pid int) []string {
+	data, err := os.ReadFile(path.Join("/proc", strconv.Itoa(pid), "stat"))
+	if err != nil {
+		return nil
+	}
+
+	// Skip the process name, which may contain spaces and parentheses
+	i := strings.LastIndex(string(data), ") ")
+	if i < 0 {
+		return nil
+	}
+
+	return strings.Fields(string(data)[i+2:])
+}
+
+// Get the parent process ID of a process. Returns 0 if the process does not exist
+func getParentProcessID(pid int) int {
+	fields := getProcessStatFields(pid)
+	if len(fields) < 2 {
+		return 0
+	}
+
+	ppid, _ := strconv.Atoi(fields[1])
+	return ppid
+}
+
+// Check whether a process exists and has not exited. Exited processes that have not been reaped yet are not running
+func isProcessRunning(pid int) bool {
+	fields := getProcessStatFields(pid)
+	return len(fields) > 0 && fields[0] != "Z"
+}
+
+// Close the notify socket and remove its file
+func closeNotifySocket(conn *net.UnixConn) {
+	if conn == nil {
+		return
+	}
+
+	socketPath := conn.LocalAddr().String()
+	conn.Close()
+	os.Remove(socketPath)
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+)
+
+// Version of the framed socket protocol. Clients that do not start with a hello command use the legacy protocol,
+// which handles a single unframed request per connection
+const protocolVersion = 1
+
+const (
+	errorCodeFailed             = "failed"
+	errorCodeInvalidRequest     = "invalid_request"
+	errorCodeUnknownCommand     = "unknown_command"
+	errorCodeNotFound           = "not_found"
+	errorCodeUnsupportedVersion = "unsupported_version"
+	errorCodePermissionDenied   = "permission_denied"
+)
+
+type commandError struct {
+	code string
+	err  error
+}
+
+func (err commandError) Error() string {
+	return err.err.Error()
+}
+
+func newCommandError(code, format string, v ...any) error {
+	return commandError{code: code, err: fmt.Errorf(format, v...)}
+}
+
+// Get the error code of an error returned to a client
+func getErrorCode(err error) string {
+	var cmdErr commandError
+	if errors.As(err, &cmdErr) {
+		return cmdErr.code
+	}
+
+	return errorCodeFailed
+}
+
+// Connection wrapper that adds the request ID to responses written by command handlers and writes them as
+// newline-delimited JSON. Responses of concurrent requests on the same connection are serialized
+type framedConn struct {
+	net.Conn
+	id         any
+	writeMutex *sync.Mutex
+	// Closed once the client stops sending requests
+	closed <-chan bool
+}
+
+func (conn framedConn) Write(data []byte) (int, error) {
+	var response map[string]any
+	if err := json.Unmarshal(data, &response); err != nil {
+		return 0, err
+	}
+	response["id"] = conn.id
+
+	framedData, err := json.Marshal(response)
+	if err != nil {
+		return 0, err
+	}
+
+	conn.writeMutex.Lock()
+	defer conn.writeMutex.Unlock()
+	if _, err := conn.Conn.Write(append(framedData, '\n')); err != nil {
+		return 0, err
+	}
+
+	return len(data), nil
+}
+
+// Handle a connection using the framed protocol after the client has sent its hello command
+func handleFramedConnection(conn net.Conn, decoder *json.Decoder, hello map[string]any, peer *peerCredentials) {
+	writeMutex := &sync.Mutex{}
+	helloConn := framedConn{Conn: conn, id: hello["id"], writeMutex: writeMutex}
+
+	// Negotiate protocol version
+	version, ok := hello["protocol_version"].(float64)
+	if !ok || version < 1 {
+		helloConn.Write(wrapErrorInJson(newCommandError(errorCodeInvalidRequest, "'protocol_version' field missing or invalid")))
+		return
+	} else if int(version) > protocolVersion {
+		helloConn.Write(wrapErrorInJson(newCommandError(errorCodeUnsupportedVersion, "protocol version %d is not supported, latest supported version is %d", int(version), protocolVersion)))
+		return
+	}
+	response, _ := json.Marshal(map[string]any{"success": "Connected to ESVM", "protocol_version": protocolVersion})
+	helloConn.Write(response)
+
+	// Handle requests until the client closes the connection
+	var waitGroup sync.WaitGroup
+	defer waitGroup.Wait()
+	closed := make(chan bool)
+	defer close(closed)
+	for {
+		var request map[string]any
+		if err := decoder.Decode(&request); err != nil {
+			var syntaxErr *json.SyntaxError
+			if errors.As(err, &syntaxErr) {
+				framedConn{Conn: conn, writeMutex: writeMutex}.Write(wrapErrorInJson(newCommandError(errorCodeInvalidRequest, "Invalid JSON")))
+			}
+			return
+		}
+
+		waitGroup.Add(1)
+		go func() {
+			defer waitGroup.Done()
+			defer recoverFromPanic()
+			handleRequest(framedConn{Conn: conn, id: request["id"], writeMutex: writeMutex, closed: closed}, request, peer)
+		}()
+	}
+}
+
+// Run the command handler for a request if the client is allowed to run the command
+func handleRequest(conn net.Conn, request map[string]any, peer *peerCredentials) {
+	// Get command to execute
+	command, ok := request["command"].(string)
+	if !ok {
+		conn.Write(wrapErrorInJson(newCommandError(errorCodeInvalidRequest, "'command' field missing")))
+		return
+	}
+
+	// Ensure client is allowed to run the command
+	if !peer.isAllowed(command) {
+		conn.Write(wrapErrorInJson(newCommandError(errorCodePermissionDenied, "permission denied to run command (%s)", command)))
+		return
+	}
+
+	// Get command handler
+	commandHandler, ok := commandHandlers[command]
+	if !ok {
+		conn.Write(wrapErrorInJson(newCommandError(errorCodeUnknownCommand, "command (%s) has not been implemented", command)))
+		return
+	}
+	commandHandler(conn, request)
+}
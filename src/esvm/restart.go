@@ -0,0 +1,142 @@
+package main
+
+import (
+	"fmt"
+	"os/exec"
+	"slices"
+	"syscall"
+	"time"
+)
+
+var restartPolicies = []string{"never", "always", "on-success", "on-failure", "on-abnormal"}
+
+// Check whether the restart settings of the service are valid and set their defaults
+func (service *EnitService) validateRestartSettings() error {
+	// Keep compatibility with older service files
+	switch service.Restart {
+	case "", "false":
+		service.Restart = "never"
+	case "true":
+		service.Restart = "on-failure"
+	}
+	if !slices.Contains(restartPolicies, service.Restart) {
+		return fmt.Errorf("unknown restart policy (%s)", service.Restart)
+	}
+
+	if service.RestartDelay < 0 || service.RestartDelayMax < 0 || service.StartLimitBurst < 0 || service.StartLimitInterval < 0 {
+		return fmt.Errorf("restart settings cannot be negative")
+	}
+	if service.RestartDelay == 0 {
+		service.RestartDelay = 1
+	}
+	if service.RestartDelayMax == 0 {
+		service.RestartDelayMax = 60
+	}
+	if service.RestartDelayMax < service.RestartDelay {
+		return fmt.Errorf("restart_delay_max cannot be lower than restart_delay")
+	}
+	// With the default delays of 1, 2, 4 and 8 seconds five restarts happen within 1+2+4+8 = 15 seconds, so the
+	// interval must be longer than that for the start limit to be reached. Services that are always restarted, like
+	// gettys, have no start limit unless one is set explicitly
+	if service.StartLimitBurst == 0 && service.Restart != "always" {
+		service.StartLimitBurst = 5
+	}
+	if service.StartLimitInterval == 0 {
+		service.StartLimitInterval = 60
+	}
+
+	return nil
+}
+
+// Check whether the restart policy of the service applies to the way its process has exited
+func (service *EnitService) shouldRestart(waitErr error) bool {
+	// Exit caused by a signal or a timeout
+	abnormal := false
+	if exitErr, ok := waitErr.(*exec.ExitError); ok {
+		if status, ok := exitErr.Sys().(syscall.WaitStatus); ok && status.Signaled() {
+			abnormal = true
+		}
+	} else if waitErr != nil {
+		abnormal = true
+	}
+
+	switch service.Restart {
+	case "always":
+		return true
+	case "on-success":
+		return waitErr == nil
+	case "on-failure":
+		return waitErr != nil
+	case "on-abnormal":
+		return abnormal
+	default:
+		return false
+	}
+}
+
+// Get the delay before the next restart, doubling it for every restart in a row up to the configured maximum
+func (service *EnitService) getRestartDelay() time.Duration {
+	delay := time.Duration(service.RestartDelay) * time.Second
+	for i := 0; i < service.restartCount && delay < time.Duration(service.RestartDelayMax)*time.Second; i++ {
+		delay *= 2
+	}
+
+	return min(delay, time.Duration(service.RestartDelayMax)*time.Second)
+}
+
+// Restart the service after its process has exited if its restart policy allows it. Services restarted too often
+// within the start limit interval enter the failed state
+func (service *EnitService) scheduleRestart(waitErr error) {
+	if !service.shouldRestart(waitErr) {
+		return
+	}
+
+	// Reset backoff if the service has been running for long enough
+	interval := time.Duration(service.StartLimitInterval) * time.Second
+	if time.Since(service.startedAt) >= interval {
+		service.restartCount = 0
+	}
+
+	// Remove restarts outside of the start limit interval
+	service.restartTimes = slices.DeleteFunc(service.restartTimes, func(t time.Time) bool {
+		return time.Since(t) >= interval
+	})
+	if service.StartLimitBurst > 0 && len(service.restartTimes) >= service.StartLimitBurst {
+		logger.Printf("Service (%s) has been restarted too often, giving up\n", service.Name)
+		service.setState(EnitServiceFailed)
+		return
+	}
+	service.restartTimes = append(service.restartTimes, time.Now())
+
+	delay := service.getRestartDelay()
+	service.restartCount++
+	logger.Printf("Restarting service (%s) in %s\n", service.Name, delay)
+	publishEvent(esvmEvent{Type: "restart_scheduled", Service: service.Name, RestartDelay: int(delay.Seconds())})
+
+	serviceName := service.Name
+	service.restartTimer = time.AfterFunc(delay, func() {
+		if sv := GetServiceByName(serviceName); sv != nil {
+			if err := sv.StartService(); err != nil {
+				logger.Printf("Error: could not restart service (%s): %s\n", serviceName, err)
+			}
+		}
+	})
+}
+
+// Cancel a scheduled restart of the service
+func (service *EnitService) cancelRestart() {
+	if service.restartTimer != nil {
+		service.restartTimer.Stop()
+		service.restartTimer = nil
+	}
+}
+
+// Leave the failed state and reset the restart counters of the service
+func (service *EnitService) ResetFailed() {
+	service.cancelRestart()
+	service.restartCount = 0
+	service.restartTimes = nil
+	if service.state == EnitServiceFailed {
+		service.setState(EnitServiceStopped)
+	}
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"fmt"
+	"maps"
+	"slices"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+var rlimitResources = map[string]int{
+	"as":         unix.RLIMIT_AS,
+	"core":       unix.RLIMIT_CORE,
+	"cpu":        unix.RLIMIT_CPU,
+	"data":       unix.RLIMIT_DATA,
+	"fsize":      unix.RLIMIT_FSIZE,
+	"locks":      unix.RLIMIT_LOCKS,
+	"memlock":    unix.RLIMIT_MEMLOCK,
+	"msgqueue":   unix.RLIMIT_MSGQUEUE,
+	"nice":       unix.RLIMIT_NICE,
+	"nofile":     unix.RLIMIT_NOFILE,
+	"nproc":      unix.RLIMIT_NPROC,
+	"rss":        unix.RLIMIT_RSS,
+	"rtprio":     unix.RLIMIT_RTPRIO,
+	"rttime":     unix.RLIMIT_RTTIME,
+	"sigpending": unix.RLIMIT_SIGPENDING,
+	"stack":      unix.RLIMIT_STACK,
+}
+
+// Parse a map of resource names to limits in the format "value" or "soft:hard"
+func parseRlimits(limits map[string]string) (map[int]syscall.Rlimit, error) {
+	rlimits := make(map[int]syscall.Rlimit)
+
+	for name, value := range limits {
+		resource, ok := rlimitResources[strings.ToLower(name)]
+		if !ok {
+			return nil, fmt.Errorf("unknown resource limit (%s)", name)
+		}
+
+		softStr, hardStr, ok := strings.Cut(value, ":")
+		if !ok {
+			hardStr = softStr
+		}
+
+		soft, err := parseRlimitValue(softStr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid value for resource limit (%s): %s", name, err)
+		}
+		hard, err := parseRlimitValue(hardStr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid value for resource limit (%s): %s", name, err)
+		}
+
+		if soft > hard {
+			return nil, fmt.Errorf("soft limit is greater than hard limit for resource limit (%s)", name)
+		}
+
+		rlimits[resource] = syscall.Rlimit{Cur: soft, Max: hard}
+	}
+
+	return rlimits, nil
+}
+
+func parseRlimitValue(value string) (uint64, error) {
+	value = strings.TrimSpace(value)
+	if value == "infinity" || value == "unlimited" {
+		return unix.RLIM_INFINITY, nil
+	}
+
+	return strconv.ParseUint(value, 10, 64)
+}
+
+func formatRlimitValue(value uint64) string {
+	if value == unix.RLIM_INFINITY {
+		return "infinity"
+	}
+
+	return strconv.FormatUint(value, 10)
+}
+
+// Get the resource limits of the service in the format "soft:hard"
+func (service *EnitService) getFormattedRlimits() map[string]string {
+	formatted := make(map[string]string)
+	for _, name := range slices.Sorted(maps.Keys(rlimitResources)) {
+		if rlimit, ok := service.rlimits[rlimitResources[name]]; ok {
+			formatted[name] = formatRlimitValue(rlimit.Cur) + ":" + formatRlimitValue(rlimit.Max)
+		}
+	}
+
+	return formatted
+}
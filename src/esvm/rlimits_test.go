@@ -0,0 +1,57 @@
+package main
+
+import (
+	"maps"
+	"syscall"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestParseRlimits(t *testing.T) {
+	tests := []struct {
+		limits map[string]string
+		want   map[int]syscall.Rlimit
+	}{
+		{map[string]string{"nofile": "1024"}, map[int]syscall.Rlimit{unix.RLIMIT_NOFILE: {Cur: 1024, Max: 1024}}},
+		{map[string]string{"nofile": "1024:4096"}, map[int]syscall.Rlimit{unix.RLIMIT_NOFILE: {Cur: 1024, Max: 4096}}},
+		{map[string]string{"NOFILE": " 1024 : 4096 "}, map[int]syscall.Rlimit{unix.RLIMIT_NOFILE: {Cur: 1024, Max: 4096}}},
+		{map[string]string{"core": "infinity"}, map[int]syscall.Rlimit{unix.RLIMIT_CORE: {Cur: unix.RLIM_INFINITY, Max: unix.RLIM_INFINITY}}},
+		{map[string]string{"core": "0:unlimited"}, map[int]syscall.Rlimit{unix.RLIMIT_CORE: {Cur: 0, Max: unix.RLIM_INFINITY}}},
+		{map[string]string{"nproc": "64", "stack": "8388608:infinity"}, map[int]syscall.Rlimit{
+			unix.RLIMIT_NPROC: {Cur: 64, Max: 64},
+			unix.RLIMIT_STACK: {Cur: 8388608, Max: unix.RLIM_INFINITY},
+		}},
+	}
+
+	for _, test := range tests {
+		got, err := parseRlimits(test.limits)
+		if err != nil {
+			t.Errorf("parseRlimits(%v) returned error: %s", test.limits, err)
+			continue
+		}
+		if !maps.Equal(got, test.want) {
+			t.Errorf("parseRlimits(%v) = %v, want %v", test.limits, got, test.want)
+		}
+	}
+}
+
+func TestParseRlimitsInvalid(t *testing.T) {
+	limits := []map[string]string{
+		{"files": "1024"},
+		{"": "1024"},
+		{"nofile": ""},
+		{"nofile": "-1"},
+		{"nofile": "many"},
+		{"nofile": "1024:"},
+		{"nofile": "1:2:3"},
+		{"nofile": "4096:1024"},
+		{"core": "infinity:0"},
+	}
+
+	for _, limit := range limits {
+		if _, err := parseRlimits(limit); err == nil {
+			t.Errorf("parseRlimits(%v) did not return an error", limit)
+		}
+	}
+}
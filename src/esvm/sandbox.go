@@ -0,0 +1,402 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+type sandboxConfig struct {
+	PrivateTmp        bool     `json:"private_tmp,omitempty"`
+	PrivateNetwork    bool     `json:"private_network,omitempty"`
+	PrivateDevices    bool     `json:"private_devices,omitempty"`
+	ProtectSystem     bool     `json:"protect_system,omitempty"`
+	ReadOnlyPaths     []string `json:"read_only_paths,omitempty"`
+	InaccessiblePaths []string `json:"inaccessible_paths,omitempty"`
+	BindPaths         []string `json:"bind_paths,omitempty"`
+	NoNewPrivileges   bool     `json:"no_new_privileges,omitempty"`
+	StagingDirectory  string   `json:"staging_directory,omitempty"`
+}
+
+var protectedSystemPaths = []string{"/usr", "/boot", "/efi", "/etc"}
+
+var privateDeviceNodes = []string{"null", "zero", "full", "random", "urandom", "tty"}
+
+// Get the sandboxing options of the service. Returns nil if no sandboxing is used
+func (service *EnitService) getSandboxConfig() *sandboxConfig {
+	config := &sandboxConfig{
+		PrivateTmp:        service.PrivateTmp,
+		PrivateNetwork:    service.PrivateNetwork,
+		PrivateDevices:    service.PrivateDevices,
+		ProtectSystem:     service.ProtectSystem,
+		ReadOnlyPaths:     service.ReadOnlyPaths,
+		InaccessiblePaths: service.InaccessiblePaths,
+		BindPaths:         service.BindPaths,
+		NoNewPrivileges:   service.NoNewPrivileges,
+		StagingDirectory:  runtimeServiceDir,
+	}
+
+	if !config.needsMountNamespace() && !config.PrivateNetwork && !config.NoNewPrivileges {
+		return nil
+	}
+
+	return config
+}
+
+func (config *sandboxConfig) needsMountNamespace() bool {
+	return config.PrivateTmp || config.PrivateDevices || config.ProtectSystem ||
+		len(config.ReadOnlyPaths) > 0 || len(config.InaccessiblePaths) > 0 || len(config.BindPaths) > 0
+}
+
+// Get the namespaces the service process should be moved into
+func (config *sandboxConfig) getUnshareFlags() uintptr {
+	if config == nil {
+		return 0
+	}
+
+	flags := uintptr(0)
+	if config.needsMountNamespace() {
+		flags |= syscall.CLONE_NEWNS
+	}
+	if config.PrivateNetwork {
+		flags |= syscall.CLONE_NEWNET
+	}
+
+	return flags
+}
+
+// Start a process that creates the sandbox namespaces of the service and keeps them alive until the service has
+// stopped. All commands of the service join these namespaces, so hooks and the service share the same private /tmp
+// and network namespace. Does nothing if the service does not need new namespaces
+func (service *EnitService) createSandbox(logFile *os.File) error {
+	config := service.getSandboxConfig()
+	if config.getUnshareFlags() == 0 {
+		return nil
+	}
+
+	configJson, err := json.Marshal(spawnConfig{Umask: -1, Sandbox: config, HoldSandbox: true})
+	if err != nil {
+		return err
+	}
+
+	// Run esvm as a helper to setup the sandbox. It is kept out of the service cgroup and process group so it
+	// outlives the service processes
+	cmd := exec.Command("/proc/self/exe", spawnHelperArg)
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		Unshareflags: config.getUnshareFlags(),
+		Setpgid:      true,
+	}
+	cmd.Env = []string{spawnConfigEnv + "=" + string(configJson)}
+	if logFile != nil {
+		cmd.Stderr = logFile
+	}
+	readyReader, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+
+	// Wait for the helper to finish setting up the sandbox
+	if _, err := io.ReadAtLeast(readyReader, make([]byte, 1), 1); err != nil {
+		cmd.Process.Kill()
+		cmd.Wait()
+		return fmt.Errorf("could not setup sandbox")
+	}
+
+	service.sandboxCmd = cmd
+	return nil
+}
+
+// Kill the process keeping the sandbox namespaces of the service alive
+func (service *EnitService) destroySandbox() {
+	if service.sandboxCmd == nil {
+		return
+	}
+
+	service.sandboxCmd.Process.Kill()
+	service.sandboxCmd.Wait()
+	service.sandboxCmd = nil
+}
+
+// Get the ID of the process holding the sandbox namespaces of the service. Returns 0 if there is none
+func (service *EnitService) getSandboxPID() int {
+	if service.sandboxCmd == nil {
+		return 0
+	}
+
+	return service.sandboxCmd.Process.Pid
+}
+
+// Move the current thread into the sandbox namespaces of another process. Must be run on a locked thread, which is
+// the only thread of the process left after executing the command
+func joinSandbox(pid int, config *sandboxConfig) error {
+	joinNamespace := func(namespace string, nstype int) error {
+		fd, err := unix.Open(path.Join("/proc", strconv.Itoa(pid), "ns", namespace), unix.O_RDONLY|unix.O_CLOEXEC, 0)
+		if err != nil {
+			return err
+		}
+		defer unix.Close(fd)
+
+		return unix.Setns(fd, nstype)
+	}
+
+	if config.PrivateNetwork {
+		if err := joinNamespace("net", unix.CLONE_NEWNET); err != nil {
+			return fmt.Errorf("could not join network namespace: %s", err)
+		}
+	}
+
+	if config.needsMountNamespace() {
+		// Threads sharing filesystem attributes with other threads cannot join a mount namespace
+		if err := unix.Unshare(unix.CLONE_FS); err != nil {
+			return err
+		}
+		if err := joinNamespace("mnt", unix.CLONE_NEWNS); err != nil {
+			return fmt.Errorf("could not join mount namespace: %s", err)
+		}
+	}
+
+	return nil
+}
+
+// Check whether the bind path definitions are valid
+func validateBindPaths(bindPaths []string) error {
+	for _, bindPath := range bindPaths {
+		source, target, options := parseBindPath(bindPath)
+		if !path.IsAbs(source) || !path.IsAbs(target) {
+			return fmt.Errorf("bind path (%s) must use absolute paths", bindPath)
+		}
+		if options != "" && options != "ro" && options != "rw" {
+			return fmt.Errorf("unknown bind path option (%s)", options)
+		}
+	}
+
+	return nil
+}
+
+// Parse a bind path in the format "source[:target[:ro|rw]]"
+func parseBindPath(bindPath string) (source, target, options string) {
+	parts := strings.SplitN(strings.TrimPrefix(bindPath, "-"), ":", 3)
+	source, target = parts[0], parts[0]
+	if len(parts) > 1 {
+		target = parts[1]
+	}
+	if len(parts) > 2 {
+		options = parts[2]
+	}
+
+	return source, target, options
+}
+
+// Bind mount a path onto itself or another path, optionally as read-only
+func bindMount(source, target string, readOnly bool) error {
+	if err := unix.Mount(source, target, "", unix.MS_BIND|unix.MS_REC, ""); err != nil {
+		return err
+	}
+
+	if readOnly {
+		return unix.Mount("", target, "", unix.MS_BIND|unix.MS_REMOUNT|unix.MS_RDONLY, "")
+	}
+
+	return nil
+}
+
+// Setup the sandbox of the current process. Must be run in a new mount namespace before dropping privileges
+func setupSandbox(config *sandboxConfig) error {
+	// Bring up loopback interface in private network namespace
+	if config.PrivateNetwork {
+		if err := setLoopbackUp(); err != nil {
+			return fmt.Errorf("could not bring up loopback interface: %s", err)
+		}
+	}
+
+	if !config.needsMountNamespace() {
+		return nil
+	}
+
+	// Create a tmpfs for sandbox files
+	stagingDir, err := os.MkdirTemp(config.StagingDirectory, "sandbox-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(stagingDir)
+	if err := unix.Mount("tmpfs", stagingDir, "tmpfs", unix.MS_NOSUID|unix.MS_NODEV, "mode=755"); err != nil {
+		return fmt.Errorf("could not mount sandbox tmpfs: %s", err)
+	}
+	defer unix.Unmount(stagingDir, unix.MNT_DETACH)
+
+	// Mount bind paths
+	for _, bindPath := range config.BindPaths {
+		source, target, options := parseBindPath(bindPath)
+		if _, err := os.Stat(source); os.IsNotExist(err) && strings.HasPrefix(bindPath, "-") {
+			continue
+		}
+
+		if err := bindMount(source, target, options == "ro"); err != nil {
+			return fmt.Errorf("could not bind mount %s to %s: %s", source, target, err)
+		}
+	}
+
+	// Mount private /tmp and /var/tmp
+	if config.PrivateTmp {
+		for _, tmpDir := range []string{"/tmp", "/var/tmp"} {
+			if _, err := os.Stat(tmpDir); err != nil {
+				continue
+			}
+
+			if err := unix.Mount("tmpfs", tmpDir, "tmpfs", unix.MS_NOSUID|unix.MS_NODEV, "mode=1777"); err != nil {
+				return fmt.Errorf("could not mount private %s: %s", tmpDir, err)
+			}
+		}
+	}
+
+	// Mount private /dev with only pseudo devices
+	if config.PrivateDevices {
+		if err := setupPrivateDevices(path.Join(stagingDir, "dev")); err != nil {
+			return fmt.Errorf("could not setup private /dev: %s", err)
+		}
+	}
+
+	// Make system directories read-only
+	if config.ProtectSystem {
+		for _, systemPath := range protectedSystemPaths {
+			if _, err := os.Stat(systemPath); err != nil {
+				continue
+			}
+
+			if err := bindMount(systemPath, systemPath, true); err != nil {
+				return fmt.Errorf("could not make %s read-only: %s", systemPath, err)
+			}
+		}
+	}
+
+	// Make paths read-only
+	for _, readOnlyPath := range config.ReadOnlyPaths {
+		optional := strings.HasPrefix(readOnlyPath, "-")
+		readOnlyPath = strings.TrimPrefix(readOnlyPath, "-")
+		if _, err := os.Stat(readOnlyPath); os.IsNotExist(err) && optional {
+			continue
+		}
+
+		if err := bindMount(readOnlyPath, readOnlyPath, true); err != nil {
+			return fmt.Errorf("could not make %s read-only: %s", readOnlyPath, err)
+		}
+	}
+
+	// Make paths inaccessible
+	if len(config.InaccessiblePaths) > 0 {
+		inaccessibleDir := path.Join(stagingDir, "inaccessible-dir")
+		inaccessibleFile := path.Join(stagingDir, "inaccessible-file")
+		if err := os.Mkdir(inaccessibleDir, 0000); err != nil {
+			return err
+		}
+		if err := os.WriteFile(inaccessibleFile, nil, 0000); err != nil {
+			return err
+		}
+
+		for _, inaccessiblePath := range config.InaccessiblePaths {
+			optional := strings.HasPrefix(inaccessiblePath, "-")
+			inaccessiblePath = strings.TrimPrefix(inaccessiblePath, "-")
+			stat, err := os.Stat(inaccessiblePath)
+			if os.IsNotExist(err) && optional {
+				continue
+			} else if err != nil {
+				return fmt.Errorf("could not make %s inaccessible: %s", inaccessiblePath, err)
+			}
+
+			source := inaccessibleFile
+			if stat.IsDir() {
+				source = inaccessibleDir
+			}
+			if err := bindMount(source, inaccessiblePath, true); err != nil {
+				return fmt.Errorf("could not make %s inaccessible: %s", inaccessiblePath, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// Create a minimal /dev in the staging directory and move it over /dev
+func setupPrivateDevices(devDir string) error {
+	if err := os.Mkdir(devDir, 0755); err != nil {
+		return err
+	}
+	if err := unix.Mount("tmpfs", devDir, "tmpfs", unix.MS_NOSUID|unix.MS_NOEXEC, "mode=755"); err != nil {
+		return err
+	}
+
+	// Bind mount pseudo devices
+	for _, node := range privateDeviceNodes {
+		if _, err := os.Stat(path.Join("/dev", node)); err != nil {
+			continue
+		}
+		if err := os.WriteFile(path.Join(devDir, node), nil, 0666); err != nil {
+			return err
+		}
+		if err := bindMount(path.Join("/dev", node), path.Join(devDir, node), false); err != nil {
+			return err
+		}
+	}
+
+	// Create standard symlinks
+	symlinks := map[string]string{
+		"fd":     "/proc/self/fd",
+		"stdin":  "/proc/self/fd/0",
+		"stdout": "/proc/self/fd/1",
+		"stderr": "/proc/self/fd/2",
+	}
+	for name, target := range symlinks {
+		if err := os.Symlink(target, path.Join(devDir, name)); err != nil {
+			return err
+		}
+	}
+
+	// Mount private /dev/pts and /dev/shm
+	for _, dir := range []string{"pts", "shm"} {
+		if err := os.Mkdir(path.Join(devDir, dir), 0755); err != nil {
+			return err
+		}
+	}
+	if err := unix.Mount("devpts", path.Join(devDir, "pts"), "devpts", unix.MS_NOSUID|unix.MS_NOEXEC, "newinstance,ptmxmode=0666,mode=620"); err != nil {
+		return err
+	}
+	if err := os.Symlink("pts/ptmx", path.Join(devDir, "ptmx")); err != nil {
+		return err
+	}
+	if err := unix.Mount("tmpfs", path.Join(devDir, "shm"), "tmpfs", unix.MS_NOSUID|unix.MS_NODEV, "mode=1777"); err != nil {
+		return err
+	}
+
+	return unix.Mount(devDir, "/dev", "", unix.MS_MOVE, "")
+}
+
+// Set the loopback interface of the current network namespace up
+func setLoopbackUp() error {
+	fd, err := unix.Socket(unix.AF_INET, unix.SOCK_DGRAM|unix.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return err
+	}
+	defer unix.Close(fd)
+
+	ifreq, err := unix.NewIfreq("lo")
+	if err != nil {
+		return err
+	}
+	if err := unix.IoctlIfreq(fd, unix.SIOCGIFFLAGS, ifreq); err != nil {
+		return err
+	}
+
+	ifreq.SetUint16(ifreq.Uint16() | unix.IFF_UP)
+	return unix.IoctlIfreq(fd, unix.SIOCSIFFLAGS, ifreq)
+}
@@ -1,9 +1,10 @@
 package main
 
 import (
-	"crypto/sha256"
+	"encoding/json"
 	"fmt"
 	"io"
+	"net"
 	"os"
 	"os/exec"
 	"os/user"
@@ -11,9 +12,11 @@ import (
 	"slices"
 	"strconv"
 	"strings"
+	"sync"
 	"syscall"
 	"time"
 
+	"golang.org/x/sys/unix"
 	"gopkg.in/yaml.v3"
 )
 
@@ -27,6 +30,11 @@ const (
 	EnitServiceStopped
 	EnitServiceCrashed
 	EnitServiceCompleted
+	EnitServiceReloading
+	EnitServiceStopping
+	EnitServiceListening
+	EnitServiceWaiting
+	EnitServiceFailed
 )
 
 var EnitServiceStateNames map[EnitServiceState]string = map[EnitServiceState]string{
@@ -37,32 +45,256 @@ var EnitServiceStateNames map[EnitServiceState]string = map[EnitServiceState]str
 	EnitServiceStopped:   "stopped",
 	EnitServiceCrashed:   "crashed",
 	EnitServiceCompleted: "completed",
+	EnitServiceReloading: "reloading",
+	EnitServiceStopping:  "stopping",
+	EnitServiceListening: "listening",
+	EnitServiceWaiting:   "waiting",
+	EnitServiceFailed:    "failed",
 }
 
 type EnitService struct {
-	Name             string `yaml:"name"`
-	Description      string `yaml:"description,omitempty"`
-	Type             string `yaml:"type"`
-	StartCmd         string `yaml:"start_cmd"`
-	CrashOnSafeExit  bool   `yaml:"crash_on_safe_exit"`
-	StopCmd          string `yaml:"stop_cmd,omitempty"`
-	User             string `yaml:"user,omitempty"`
-	Restart          string `yaml:"restart,omitempty"`
-	ReadyFd          int    `yaml:"ready_fd"`
-	Setpgid          bool   `yaml:"setpgid"`
-	LogOutput        bool   `yaml:"log_output,omitempty"`
-	Filepath         string
-	filepathChecksum [32]byte
-	state            EnitServiceState
-	processID        int
-	restartCount     int
-	stopChannel      chan bool
-	shouldReload     bool
+	Name                string                  `yaml:"name"`
+	Description         string                  `yaml:"description,omitempty"`
+	Type                string                  `yaml:"type"`
+	StartCmd            string                  `yaml:"start_cmd"`
+	CrashOnSafeExit     bool                    `yaml:"crash_on_safe_exit"`
+	StopCmd             string                  `yaml:"stop_cmd,omitempty"`
+	ReloadCmd           string                  `yaml:"reload_cmd,omitempty"`
+	ReloadSignal        string                  `yaml:"reload_signal,omitempty"`
+	StartPre            []string                `yaml:"start_pre,omitempty"`
+	StartPost           []string                `yaml:"start_post,omitempty"`
+	StopPre             []string                `yaml:"stop_pre,omitempty"`
+	StopPost            []string                `yaml:"stop_post,omitempty"`
+	HealthCheck         *EnitServiceHealthCheck `yaml:"health_check,omitempty"`
+	WatchdogSec         int                     `yaml:"watchdog_sec,omitempty"`
+	User                string                  `yaml:"user,omitempty"`
+	Restart             string                  `yaml:"restart,omitempty"`
+	RestartDelay        int                     `yaml:"restart_delay,omitempty"`
+	RestartDelayMax     int                     `yaml:"restart_delay_max,omitempty"`
+	StartLimitBurst     int                     `yaml:"start_limit_burst,omitempty"`
+	StartLimitInterval  int                     `yaml:"start_limit_interval,omitempty"`
+	ReadyFd             int                     `yaml:"ready_fd"`
+	Setpgid             bool                    `yaml:"setpgid"`
+	LogOutput           bool                    `yaml:"log_output,omitempty"`
+	Requires            []string                `yaml:"requires,omitempty"`
+	Wants               []string                `yaml:"wants,omitempty"`
+	After               []string                `yaml:"after,omitempty"`
+	Before              []string                `yaml:"before,omitempty"`
+	Sockets             []EnitServiceSocket     `yaml:"sockets,omitempty"`
+	Timer               *EnitServiceTimer       `yaml:"timer,omitempty"`
+	Environment         map[string]string       `yaml:"environment,omitempty"`
+	EnvironmentFiles    []string                `yaml:"environment_files,omitempty"`
+	WorkingDirectory    string                  `yaml:"working_directory,omitempty"`
+	Umask               string                  `yaml:"umask,omitempty"`
+	RootDirectory       string                  `yaml:"root_directory,omitempty"`
+	Group               string                  `yaml:"group,omitempty"`
+	SupplementaryGroups []string                `yaml:"supplementary_groups,omitempty"`
+	Limits              map[string]string       `yaml:"limits,omitempty"`
+	MemoryMax           string                  `yaml:"memory_max,omitempty"`
+	MemoryHigh          string                  `yaml:"memory_high,omitempty"`
+	CPUWeight           int                     `yaml:"cpu_weight,omitempty"`
+	CPUMax              string                  `yaml:"cpu_max,omitempty"`
+	IOWeight            int                     `yaml:"io_weight,omitempty"`
+	PidsMax             string                  `yaml:"pids_max,omitempty"`
+	PrivateTmp          bool                    `yaml:"private_tmp,omitempty"`
+	PrivateNetwork      bool                    `yaml:"private_network,omitempty"`
+	PrivateDevices      bool                    `yaml:"private_devices,omitempty"`
+	ProtectSystem       bool                    `yaml:"protect_system,omitempty"`
+	ReadOnlyPaths       []string                `yaml:"read_only_paths,omitempty"`
+	InaccessiblePaths   []string                `yaml:"inaccessible_paths,omitempty"`
+	BindPaths           []string                `yaml:"bind_paths,omitempty"`
+	NoNewPrivileges     bool                    `yaml:"no_new_privileges,omitempty"`
+	Capabilities        []string                `yaml:"capabilities,omitempty"`
+	CapabilityBounding  []string                `yaml:"capability_bounding_set,omitempty"`
+	StopSignal          string                  `yaml:"stop_signal,omitempty"`
+	StopTimeout         int                     `yaml:"stop_timeout,omitempty"`
+	ReadyTimeout        int                     `yaml:"ready_timeout,omitempty"`
+	KillSignal          string                  `yaml:"kill_signal,omitempty"`
+	SendSighup          bool                    `yaml:"send_sighup,omitempty"`
+	Filepath            string
+	filepathChecksum    [32]byte
+	state               EnitServiceState
+	processID           int
+	spawnedProcessID    int
+	sandboxCmd          *exec.Cmd
+	restartCount        int
+	restartTimes        []time.Time
+	restartTimer        *time.Timer
+	startedAt           time.Time
+	stopChannel         chan bool
+	shouldReload        bool
+	statusText          string
+	lastWatchdogPing    time.Time
+	startMutex          sync.Mutex
+	activationSockets   []*activationSocket
+	timerCalendar       *calendarSpec
+	timerStopChannel    chan bool
+	lastTriggered       time.Time
+	nextElapse          time.Time
+	instance            string
+	rlimits             map[int]syscall.Rlimit
+	capabilities        uint64
+	capabilityBounding  *uint64
+	stopSignal          syscall.Signal
+	killSignal          syscall.Signal
+	reloadSignal        syscall.Signal
+	failedHook          string
+	hookExitCode        int
+	healthStopChannel   chan bool
+	healthFailures      int
+	unhealthy           bool
+	watchdogStopChannel chan bool
 }
 
 var Services = make([]*EnitService, 0)
 var startedServicesOrder = make([]string, 0)
 
+// Guards Services and startedServicesOrder, which are accessed by services starting in parallel
+var servicesMutex sync.RWMutex
+
+// Get a copy of the loaded services that is safe to iterate over
+func getServices() []*EnitService {
+	servicesMutex.RLock()
+	defer servicesMutex.RUnlock()
+
+	return slices.Clone(Services)
+}
+
+// Check whether the service has started and its process has not exited yet
+func (service *EnitService) isRunning() bool {
+	switch service.state {
+	case EnitServiceRunning, EnitServiceReloading, EnitServiceStopping:
+		return true
+	default:
+		return false
+	}
+}
+
+// Get the credentials the service commands should run with. Returns nil if the service runs as root with default groups
+func (service *EnitService) getCredential() (*syscall.Credential, error) {
+	if (service.User == "" || service.User == "root") && service.Group == "" && len(service.SupplementaryGroups) == 0 {
+		return nil, nil
+	}
+
+	username := service.User
+	if username == "" {
+		username = "root"
+	}
+
+	// Lookup user in /etc/passwd
+	u, err := user.Lookup(username)
+	if err != nil {
+		return nil, err
+	}
+
+	// Get user id and group id
+	uid, err := strconv.Atoi(u.Uid)
+	if err != nil {
+		return nil, err
+	}
+	gid, err := strconv.Atoi(u.Gid)
+	if err != nil {
+		return nil, err
+	}
+
+	// Lookup primary group in /etc/group
+	if service.Group != "" {
+		g, err := user.LookupGroup(service.Group)
+		if err != nil {
+			return nil, err
+		}
+		gid, err = strconv.Atoi(g.Gid)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// Get all groups the user is a member of
+	groupIds, err := u.GroupIds()
+	if err != nil {
+		return nil, err
+	}
+
+	// Lookup supplementary groups in /etc/group
+	for _, group := range service.SupplementaryGroups {
+		g, err := user.LookupGroup(group)
+		if err != nil {
+			return nil, err
+		}
+		groupIds = append(groupIds, g.Gid)
+	}
+
+	groups := make([]uint32, 0, len(groupIds))
+	for _, groupId := range groupIds {
+		group, err := strconv.Atoi(groupId)
+		if err != nil {
+			return nil, err
+		}
+		if !slices.Contains(groups, uint32(group)) {
+			groups = append(groups, uint32(group))
+		}
+	}
+
+	return &syscall.Credential{
+		Uid:    uint32(uid),
+		Gid:    uint32(gid),
+		Groups: groups,
+	}, nil
+}
+
+// Create a shell command that runs with the user, environment and execution options of the service
+func (service *EnitService) createCommand(command string) (*exec.Cmd, error) {
+	config := spawnConfig{
+		Command:          command,
+		Rlimits:          service.rlimits,
+		RootDirectory:    service.RootDirectory,
+		WorkingDirectory: service.WorkingDirectory,
+		Umask:            -1,
+		Sandbox:          service.getSandboxConfig(),
+		Capabilities:     service.capabilities,
+		BoundingSet:      service.capabilityBounding,
+		SandboxPID:       service.getSandboxPID(),
+	}
+
+	// Get umask
+	if service.Umask != "" {
+		umask, err := strconv.ParseUint(service.Umask, 8, 32)
+		if err != nil {
+			return nil, err
+		}
+		config.Umask = int(umask)
+	}
+
+	// Get command credentials
+	var err error
+	config.Credential, err = service.getCredential()
+	if err != nil {
+		return nil, err
+	}
+
+	// Encode spawn config
+	configJson, err := json.Marshal(config)
+	if err != nil {
+		return nil, err
+	}
+
+	// Run esvm as a helper to setup the process before executing the command
+	cmd := exec.Command("/proc/self/exe", spawnHelperArg)
+	cmd.SysProcAttr = &syscall.SysProcAttr{}
+	if config.SandboxPID == 0 {
+		cmd.SysProcAttr.Unshareflags = config.Sandbox.getUnshareFlags()
+	}
+
+	// Setup command environment
+	cmd.Env, err = service.getEnvironment()
+	if err != nil {
+		return nil, err
+	}
+	cmd.Env = append(cmd.Env, spawnConfigEnv+"="+string(configJson))
+
+	return cmd, nil
+}
+
 func (service *EnitService) GetProcess() *os.Process {
 	process, _ := os.FindProcess(service.processID)
 
@@ -103,15 +335,24 @@ func (service *EnitService) GetLogFile() (file *os.File, err error) {
 	return file, nil
 }
 
-func LoadService(filepath string) {
+func LoadService(filepath, instance string) {
+	// Templates are only loaded when one of their instances is requested
+	if isTemplateFile(filepath) != (instance != "") {
+		return
+	}
+
+	servicesMutex.Lock()
+	defer servicesMutex.Unlock()
+
 	bytes, err := os.ReadFile(filepath)
-	checksum := sha256.Sum256(bytes)
+	dropIns := getDropInFiles(filepath, instance)
+	checksum := getServiceChecksum(bytes, dropIns)
 
 	var serviceToReload *EnitService
 
 	// Check if service is already loaded
 	for _, service := range Services {
-		if service.Filepath != filepath {
+		if service.Filepath != filepath || service.instance != instance {
 			continue
 		}
 
@@ -119,7 +360,7 @@ func LoadService(filepath string) {
 			return
 		}
 
-		if service.state == EnitServiceStarting || service.state == EnitServiceRunning {
+		if service.state == EnitServiceStarting || service.state == EnitServiceListening || service.state == EnitServiceWaiting || service.isRunning() {
 			service.shouldReload = true
 			logger.Printf("Warning: Service (%s) is currently running and will be reloaded when stopped\n", service.Name)
 			return
@@ -138,8 +379,11 @@ func LoadService(filepath string) {
 
 	if os.IsNotExist(err) {
 		Services = slices.DeleteFunc(Services, func(sv *EnitService) bool {
-			if sv.Filepath == filepath {
+			if sv.Filepath == filepath && sv.instance == instance {
+				sv.closeSockets()
+				sv.disarmTimer()
 				logger.Printf("Service (%s) has been removed\n", sv.Name)
+				publishEvent(esvmEvent{Type: "service_removed", Service: sv.Name})
 				return true
 			}
 			return false
@@ -163,20 +407,32 @@ func LoadService(filepath string) {
 		CrashOnSafeExit:  true,
 		LogOutput:        true,
 		Filepath:         filepath,
-		filepathChecksum: sha256.Sum256(bytes),
+		filepathChecksum: checksum,
 		restartCount:     0,
 		stopChannel:      make(chan bool),
 		state:            EnitServiceUnloaded,
 	}
 	if serviceToReload != nil {
 		newService.restartCount = serviceToReload.restartCount
+		newService.restartTimes = serviceToReload.restartTimes
+		newService.restartTimer = serviceToReload.restartTimer
+		newService.startedAt = serviceToReload.startedAt
 		newService.stopChannel = serviceToReload.stopChannel
 		newService.state = serviceToReload.state
 	}
-	if err := yaml.Unmarshal(bytes, &newService); err != nil {
+	document, err := parseServiceFile(bytes, dropIns, instance)
+	if err != nil {
+		logger.Printf("Error: could not read service file %s: %s", filepath, err)
+		return
+	}
+	if err := document.Decode(&newService); err != nil {
 		logger.Printf("Error: could not read service file %s", filepath)
 		return
 	}
+	if instance != "" {
+		newService.Name = getInstanceName(filepath, instance)
+		newService.instance = instance
+	}
 
 	for _, sv := range Services {
 		if sv.Name == newService.Name && sv != serviceToReload {
@@ -186,38 +442,178 @@ func LoadService(filepath string) {
 	}
 
 	switch newService.Type {
-	case "simple", "background":
+	case "simple", "background", "notify":
 	default:
 		logger.Printf("Error: unknown service type (%s)", newService.Type)
 		return
 	}
 
-	switch newService.Restart {
-	case "true", "always":
-	default:
-		newService.Restart = "false"
+	for _, socket := range newService.Sockets {
+		if err := socket.validate(); err != nil {
+			logger.Printf("Error: invalid socket in service file %s: %s", filepath, err)
+			return
+		}
+	}
+	if newService.ReadyFd > 2 && newService.ReadyFd < 3+len(newService.Sockets) {
+		logger.Printf("Error: ready_fd of service (%s) conflicts with its activation sockets", newService.Name)
+		return
+	}
+
+	if newService.Umask != "" {
+		if _, err := strconv.ParseUint(newService.Umask, 8, 32); err != nil {
+			logger.Printf("Error: invalid umask (%s) in service file %s", newService.Umask, filepath)
+			return
+		}
+	}
+
+	rlimits, err := parseRlimits(newService.Limits)
+	if err != nil {
+		logger.Printf("Error: invalid limits in service file %s: %s", filepath, err)
+		return
+	}
+	newService.rlimits = rlimits
+
+	if _, err := newService.getCgroupSettings(); err != nil {
+		logger.Printf("Error: invalid cgroup settings in service file %s: %s", filepath, err)
+		return
+	}
+
+	if newService.capabilities, err = parseCapabilities(newService.Capabilities); err != nil {
+		logger.Printf("Error: invalid capabilities in service file %s: %s", filepath, err)
+		return
+	}
+	if newService.CapabilityBounding != nil {
+		boundingSet, err := parseCapabilities(newService.CapabilityBounding)
+		if err != nil {
+			logger.Printf("Error: invalid capability bounding set in service file %s: %s", filepath, err)
+			return
+		} else if newService.capabilities&^boundingSet != 0 {
+			logger.Printf("Error: capabilities in service file %s are not in the capability bounding set", filepath)
+			return
+		}
+		newService.capabilityBounding = &boundingSet
+	}
+
+	newService.stopSignal, newService.killSignal, newService.reloadSignal = syscall.SIGTERM, syscall.SIGKILL, syscall.SIGHUP
+	if newService.StopSignal != "" {
+		if newService.stopSignal, err = parseSignal(newService.StopSignal); err != nil {
+			logger.Printf("Error: invalid stop signal in service file %s: %s", filepath, err)
+			return
+		}
+	}
+	if newService.KillSignal != "" {
+		if newService.killSignal, err = parseSignal(newService.KillSignal); err != nil {
+			logger.Printf("Error: invalid kill signal in service file %s: %s", filepath, err)
+			return
+		}
+	}
+	if newService.ReloadSignal != "" {
+		if newService.reloadSignal, err = parseSignal(newService.ReloadSignal); err != nil {
+			logger.Printf("Error: invalid reload signal in service file %s: %s", filepath, err)
+			return
+		}
+	}
+	if newService.StopTimeout < 0 {
+		logger.Printf("Error: stop timeout in service file %s cannot be negative", filepath)
+		return
+	}
+	if newService.ReadyTimeout < 0 {
+		logger.Printf("Error: ready timeout in service file %s cannot be negative", filepath)
+		return
+	}
+
+	if err := validateBindPaths(newService.BindPaths); err != nil {
+		logger.Printf("Error: invalid bind paths in service file %s: %s", filepath, err)
+		return
+	}
+	for _, sandboxPath := range slices.Concat(newService.ReadOnlyPaths, newService.InaccessiblePaths) {
+		if !path.IsAbs(strings.TrimPrefix(sandboxPath, "-")) {
+			logger.Printf("Error: sandbox path (%s) in service file %s must be absolute", sandboxPath, filepath)
+			return
+		}
+	}
+
+	if newService.Timer != nil {
+		if newService.Type != "simple" || strings.TrimSpace(newService.StopCmd) != "" || len(newService.Sockets) > 0 {
+			logger.Printf("Error: timers can only be used by simple services without a stop command or sockets")
+			return
+		}
+
+		calendar, err := newService.Timer.parse()
+		if err != nil {
+			logger.Printf("Error: invalid timer in service file %s: %s", filepath, err)
+			return
+		}
+		newService.timerCalendar = calendar
+	}
+
+	if newService.WatchdogSec < 0 {
+		logger.Printf("Error: watchdog_sec in service file %s cannot be negative", filepath)
+		return
+	}
+
+	if newService.HealthCheck != nil {
+		if err := newService.HealthCheck.validate(); err != nil {
+			logger.Printf("Error: invalid health check in service file %s: %s", filepath, err)
+			return
+		}
+	}
+
+	if err := newService.validateRestartSettings(); err != nil {
+		logger.Printf("Error: invalid restart settings in service file %s: %s", filepath, err)
+		return
 	}
 
 	for i, sv := range Services {
 		if sv == serviceToReload {
+			serviceToReload.closeSockets()
+			serviceToReload.disarmTimer()
 			Services[i] = &newService
 			logger.Printf("Service (%s) has been reloaded!\n", newService.Name)
+			publishEvent(esvmEvent{Type: "service_reloaded", Service: newService.Name})
 			return
 		}
 	}
 
 	Services = append(Services, &newService)
 	logger.Printf("Service (%s) has been loaded!\n", newService.Name)
+	publishEvent(esvmEvent{Type: "service_loaded", Service: newService.Name})
 }
 
 func (service *EnitService) StartService() (err error) {
 	if service == nil {
 		return nil
 	}
-	if service.state == EnitServiceRunning {
+
+	// Prevent the service from being started multiple times concurrently
+	service.startMutex.Lock()
+	defer service.startMutex.Unlock()
+
+	if service.isRunning() {
 		return nil
 	}
 
+	// Refuse to start services that have failed until their failed state is reset
+	if service.state == EnitServiceFailed {
+		return fmt.Errorf("service has been restarted too often, reset it using reset-failed")
+	}
+	service.cancelRestart()
+
+	// Wait for incoming connections before starting socket activated services
+	if len(service.Sockets) > 0 && service.activationSockets == nil {
+		return service.listenOnSockets()
+	}
+
+	// Wait for the timer to elapse before starting timer services
+	if service.Timer != nil && service.timerStopChannel == nil {
+		return service.armTimer()
+	}
+
+	// Start required and wanted services
+	if err := service.startDependencies(); err != nil {
+		return err
+	}
+
 	logger.Printf("Starting service (%s)...\n", service.Name)
 
 	// Get log file if service logs output
@@ -229,8 +625,56 @@ func (service *EnitService) StartService() (err error) {
 		}
 	}
 
-	cmd := exec.Command("/bin/sh", "-c", "exec "+service.StartCmd)
-	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: service.Setpgid, Pgid: 0}
+	// Create sandbox shared by all commands of the service
+	if err := service.createSandbox(logFile); err != nil {
+		// Close log file if not nil
+		if logFile != nil {
+			logFile.Close()
+		}
+
+		return err
+	}
+	defer func() {
+		// Remove sandbox if the service could not be started
+		if err != nil {
+			service.destroySandbox()
+		}
+	}()
+
+	// Run pre-start hooks
+	service.failedHook = ""
+	service.hookExitCode = 0
+	if err := service.runHooks("start_pre", service.StartPre); err != nil {
+		// Close log file if not nil
+		if logFile != nil {
+			logFile.Close()
+		}
+
+		logger.Printf("Error: service (%s) has crashed: %s\n", service.Name, err)
+		service.setState(EnitServiceCrashed)
+		return err
+	}
+
+	startCmd := "exec " + service.StartCmd
+	if service.activationSockets != nil {
+		// Set LISTEN_PID to the PID of the shell, which is replaced by the service process
+		startCmd = "export LISTEN_PID=$$; " + startCmd
+	}
+	if service.WatchdogSec > 0 {
+		startCmd = "export WATCHDOG_PID=$$; " + startCmd
+	}
+
+	cmd, err := service.createCommand(startCmd)
+	if err != nil {
+		// Close log file if not nil
+		if logFile != nil {
+			logFile.Close()
+		}
+
+		return err
+	}
+	cmd.SysProcAttr.Setpgid = service.Setpgid
+	cmd.SysProcAttr.Pgid = 0
 
 	// Setup service log file
 	if logFile != nil {
@@ -238,27 +682,75 @@ func (service *EnitService) StartService() (err error) {
 		cmd.Stderr = logFile
 	}
 
-	// Setup command credentials
-	if service.User != "" && service.User != "root" {
-		// Lookup user in /etc/passwd
-		u, err := user.Lookup(service.User)
+	// Setup notify socket
+	var notifyConn *net.UnixConn
+	var notifyReady chan bool
+	if service.Type == "notify" || service.WatchdogSec > 0 {
+		notifyConn, err = service.openNotifySocket()
 		if err != nil {
+			// Close log file if not nil
+			if logFile != nil {
+				logFile.Close()
+			}
+
 			return err
 		}
 
-		// Get user id and group id
-		uid, err := strconv.Atoi(u.Uid)
+		notifyReady = make(chan bool)
+		service.statusText = ""
+		cmd.Env = append(cmd.Env, "NOTIFY_SOCKET="+notifyConn.LocalAddr().String())
+		go service.handleNotifyMessages(notifyConn, notifyReady)
+	}
+
+	// Setup watchdog
+	if service.WatchdogSec > 0 {
+		env, err := service.setupWatchdog()
 		if err != nil {
+			// Close log file if not nil
+			if logFile != nil {
+				logFile.Close()
+			}
+			closeNotifySocket(notifyConn)
+
 			return err
 		}
-		gid, err := strconv.Atoi(u.Gid)
+
+		cmd.Env = append(cmd.Env, env...)
+	}
+
+	// Pass activation sockets
+	if service.activationSockets != nil {
+		files, env, err := service.getSocketFiles()
 		if err != nil {
+			// Close log file if not nil
+			if logFile != nil {
+				logFile.Close()
+			}
+			closeNotifySocket(notifyConn)
+
 			return err
 		}
 
-		cmd.SysProcAttr.Credential = &syscall.Credential{
-			Uid: uint32(uid),
-			Gid: uint32(gid),
+		cmd.ExtraFiles = append(cmd.ExtraFiles, files...)
+		cmd.Env = append(cmd.Env, env...)
+	}
+
+	// Place the service process in its cgroup
+	cgroupFile, err := service.createCgroup()
+	if err != nil {
+		// Close log file if not nil
+		if logFile != nil {
+			logFile.Close()
+		}
+		closeNotifySocket(notifyConn)
+
+		return err
+	}
+	if cgroupFile != nil {
+		defer cgroupFile.Close()
+		if cloneIntoCgroupSupported() {
+			cmd.SysProcAttr.UseCgroupFD = true
+			cmd.SysProcAttr.CgroupFD = int(cgroupFile.Fd())
 		}
 	}
 
@@ -275,7 +767,7 @@ func (service *EnitService) StartService() (err error) {
 			return err
 		}
 
-		err := pipeReader.SetDeadline(time.Now().Add(10 * time.Second))
+		err := pipeReader.SetDeadline(time.Now().Add(service.getReadyTimeout()))
 		if err != nil {
 			// Close log file if not nil
 			if logFile != nil {
@@ -285,7 +777,7 @@ func (service *EnitService) StartService() (err error) {
 			return err
 		}
 
-		for i := 3; i < service.ReadyFd; i++ {
+		for i := 3 + len(cmd.ExtraFiles); i < service.ReadyFd; i++ {
 			cmd.ExtraFiles = append(cmd.ExtraFiles, nil)
 		}
 		cmd.ExtraFiles = append(cmd.ExtraFiles, pipeWriter)
@@ -296,13 +788,32 @@ func (service *EnitService) StartService() (err error) {
 		if logFile != nil {
 			logFile.Close()
 		}
+		closeNotifySocket(notifyConn)
 
 		return err
 	}
 
+	// Move the process into its cgroup if the kernel could not start it there
+	if cgroupFile != nil && !cmd.SysProcAttr.UseCgroupFD {
+		if err := service.addProcessToCgroup(cmd.Process.Pid); err != nil {
+			// Close log file if not nil
+			if logFile != nil {
+				logFile.Close()
+			}
+			closeNotifySocket(notifyConn)
+
+			// Kill process and children
+			cmd.Process.Kill()
+			cmd.Wait()
+
+			return fmt.Errorf("could not move process to cgroup: %s", err)
+		}
+	}
+
 	pid := cmd.Process.Pid
 	service.processID = cmd.Process.Pid
-	service.state = EnitServiceStarting
+	service.spawnedProcessID = cmd.Process.Pid
+	service.setState(EnitServiceStarting)
 
 	// Wait for data from pipe
 	if pipeReader != nil {
@@ -315,16 +826,40 @@ func (service *EnitService) StartService() (err error) {
 			}
 
 			// Kill process and children
-			syscall.Kill(-pid, syscall.SIGKILL)
+			service.killRemainingProcesses(pid)
+			service.removeCgroup()
 
 			service.processID = 0
-			service.state = EnitServiceCrashed
+			service.setState(EnitServiceCrashed)
 
 			return err
 		}
 	}
 
-	service.state = EnitServiceRunning
+	// Wait for the service to send READY=1
+	if service.Type == "notify" {
+		select {
+		case <-notifyReady:
+		case <-time.After(service.getReadyTimeout()):
+			// Close log file if not nil
+			if logFile != nil {
+				logFile.Close()
+			}
+			closeNotifySocket(notifyConn)
+
+			// Kill process and children
+			service.killRemainingProcesses(pid)
+			service.removeCgroup()
+
+			service.processID = 0
+			service.setState(EnitServiceCrashed)
+
+			return fmt.Errorf("service did not send READY=1 in time")
+		}
+	}
+
+	service.setState(EnitServiceRunning)
+	service.startedAt = time.Now()
 
 	// Set PID to 0 for simple services with a stop command
 	if service.Type == "simple" && service.StopCmd != "" {
@@ -335,10 +870,27 @@ func (service *EnitService) StartService() (err error) {
 	go func() {
 		err := cmd.Wait()
 
+		// Keep tracking the service until the main process it announced with MAINPID has exited
+		service.waitForMainProcess()
+
 		// Close log file if not nil
 		if logFile != nil {
 			logFile.Close()
 		}
+		closeNotifySocket(notifyConn)
+
+		// Wait for new connections or the next timer elapse once the process has exited
+		defer func() {
+			if service.state == EnitServiceStarting || service.state == EnitServiceFailed || service.isRunning() {
+				return
+			}
+
+			if service.activationSockets != nil {
+				service.armSockets()
+			} else if service.timerStopChannel != nil {
+				service.setState(EnitServiceWaiting)
+			}
+		}()
 
 		select {
 		case <-service.stopChannel:
@@ -346,80 +898,146 @@ func (service *EnitService) StartService() (err error) {
 		default:
 			// Kill remaining child processes
 			if pid != 0 {
-				syscall.Kill(-pid, syscall.SIGKILL)
+				service.killRemainingProcesses(pid)
+			}
+
+			// Run post-stop hooks
+			if err := service.runHooks("stop_post", service.StopPost); err != nil {
+				logger.Printf("Warning: %s\n", err)
 			}
 
 			if service.Type == "simple" && err == nil {
-				service.restartCount = 0
-				if strings.TrimSpace(service.StopCmd) == "" {
-					service.state = EnitServiceCompleted
-
-					// Reload service if needed
-					if service.shouldReload {
-						LoadService(service.Filepath)
-					}
+				if strings.TrimSpace(service.StopCmd) != "" {
+					return
 				}
-				return
-			}
-			if !service.CrashOnSafeExit {
+				service.setExitState(EnitServiceCompleted, err)
+			} else if !service.CrashOnSafeExit {
 				logger.Printf("Service (%s) has exited\n", service.Name)
-				service.state = EnitServiceStopped
+				service.setExitState(EnitServiceStopped, err)
 			} else {
 				logger.Printf("Service (%s) has crashed!\n", service.Name)
-				service.state = EnitServiceCrashed
+				service.setExitState(EnitServiceCrashed, err)
 			}
+			service.stopHealthCheck()
+			service.stopWatchdog()
+			service.removeCgroup()
+			service.destroySandbox()
 
 			// Reload service if needed
 			if service.shouldReload {
-				LoadService(service.Filepath)
+				LoadService(service.Filepath, service.instance)
 				if GetServiceByName(service.Name) == nil {
 					return
 				}
 				service = GetServiceByName(service.Name)
 			}
 
-			if service.Restart == "always" {
-				_ = service.StartService()
-			} else if service.Restart == "true" && service.restartCount < 5 {
-				service.restartCount++
-				_ = service.StartService()
-			}
+			// Restart service according to its restart policy
+			service.scheduleRestart(err)
 		}
 
 		service.processID = 0
 	}()
 
 	// Add to started services order slice
-	if !slices.Contains(startedServicesOrder, service.Name) {
-		startedServicesOrder = append(startedServicesOrder, service.Name)
+	addToStartedServicesOrder(service.Name)
+
+	// Run post-start hooks
+	if err := service.runHooks("start_post", service.StartPost); err != nil {
+		logger.Printf("Warning: %s\n", err)
 	}
 
+	// Start periodic health checks and watchdog
+	service.startHealthCheck()
+	service.startWatchdog()
+
 	logger.Printf("Service (%s) has started!\n", service.Name)
 
 	return nil
 }
 
+func addToStartedServicesOrder(serviceName string) {
+	servicesMutex.Lock()
+	defer servicesMutex.Unlock()
+
+	if !slices.Contains(startedServicesOrder, serviceName) {
+		startedServicesOrder = append(startedServicesOrder, serviceName)
+	}
+}
+
 func (service *EnitService) StopService() error {
-	if service.state != EnitServiceRunning {
+	// Cancel scheduled restarts
+	service.cancelRestart()
+
+	// Close activation sockets of services waiting for connections
+	if service.state == EnitServiceListening {
+		service.stopDependents()
+		service.closeSockets()
+		service.setState(EnitServiceStopped)
+		logger.Printf("Service (%s) has stopped listening on its sockets\n", service.Name)
+
+		// Reload service if needed
+		if service.shouldReload {
+			LoadService(service.Filepath, service.instance)
+		}
+
+		return nil
+	}
+
+	// Stop timer of services waiting for it to elapse
+	if service.state == EnitServiceWaiting {
+		service.stopDependents()
+		service.disarmTimer()
+		service.setState(EnitServiceStopped)
+		logger.Printf("Timer for service (%s) has stopped\n", service.Name)
+
+		// Reload service if needed
+		if service.shouldReload {
+			LoadService(service.Filepath, service.instance)
+		}
+
 		return nil
 	}
 
+	if !service.isRunning() {
+		return nil
+	}
+
+	// Close activation sockets and stop timer, health checks and watchdog
+	service.closeSockets()
+	service.disarmTimer()
+	service.stopHealthCheck()
+	service.stopWatchdog()
+
+	// Stop services that require this service
+	service.stopDependents()
+
 	logger.Printf("Stopping service (%s)...", service.Name)
 	pid := service.processID
 
+	// Run pre-stop hooks
+	if err := service.runHooks("stop_pre", service.StopPre); err != nil {
+		logger.Printf("Warning: %s\n", err)
+	}
+
 	newServiceStatus := EnitServiceCrashed
 	defer func() {
 		// Kill remaining child processes
-		if pid != 0 {
-			syscall.Kill(-pid, syscall.SIGKILL)
-		}
+		service.killRemainingProcesses(pid)
+		service.removeCgroup()
 
-		service.state = newServiceStatus
+		service.setState(newServiceStatus)
 		service.processID = 0
 
+		// Run post-stop hooks
+		if err := service.runHooks("stop_post", service.StopPost); err != nil {
+			logger.Printf("Warning: %s\n", err)
+		}
+		service.destroySandbox()
+
 		// Reload service if needed
 		if service.shouldReload {
-			LoadService(service.Filepath)
+			LoadService(service.Filepath, service.instance)
 			if GetServiceByName(service.Name) == nil {
 				return
 			}
@@ -436,71 +1054,114 @@ func (service *EnitService) StopService() error {
 
 		go func() { service.stopChannel <- true }()
 
-		// Send SIGTERM signal to process
-		if err := service.GetProcess().Signal(syscall.SIGTERM); err != nil {
-			service.GetProcess().Signal(syscall.SIGKILL)
+		// Send stop signal to all service processes
+		if err := service.signalProcesses(pid, service.stopSignal); err != nil {
+			service.signalProcesses(pid, service.killSignal)
 			return fmt.Errorf("could not stop process gracefully")
 		}
+		if service.SendSighup {
+			service.signalProcesses(pid, syscall.SIGHUP)
+		}
 	} else {
 		go func() { service.stopChannel <- true }()
 
-		cmd := exec.Command("/bin/sh", "-c", service.StopCmd)
+		cmd, err := service.createCommand(service.StopCmd)
+		if err != nil {
+			return err
+		}
 
-		// Setup command credentials
-		if service.User != "" && service.User != "root" {
-			// Lookup user in /etc/passwd
-			u, err := user.Lookup(service.User)
-			if err != nil {
-				return err
-			}
+		if err := cmd.Run(); err != nil {
+			return err
+		}
+	}
 
-			// Get user id and group id
-			uid, err := strconv.Atoi(u.Uid)
-			if err != nil {
-				return err
-			}
-			gid, err := strconv.Atoi(u.Gid)
-			if err != nil {
-				return err
-			}
+	// Check if the processes have stopped gracefully, otherwise send the kill signal on timeout
+	if pid != 0 || service.hasCgroup() {
+		if !service.waitForExit(pid, service.getStopTimeout()) {
+			logger.Printf("Warning: service (%s) did not stop in time, sending %s", service.Name, unix.SignalName(service.killSignal))
+			service.signalProcesses(pid, service.killSignal)
+			service.waitForExit(pid, 5*time.Second)
+			return fmt.Errorf("could not stop process gracefully")
+		}
+	}
 
-			cmd.SysProcAttr.Credential = &syscall.Credential{
-				Uid: uint32(uid),
-				Gid: uint32(gid),
-			}
+	newServiceStatus = EnitServiceStopped
+	logger.Printf("Service (%s) has stopped!\n", service.Name)
+
+	return nil
+}
+
+// Ask the service to reload its configuration using its reload command or reload signal
+func (service *EnitService) ReloadService() error {
+	if service.state != EnitServiceRunning {
+		return fmt.Errorf("service is not running")
+	}
+
+	logger.Printf("Reloading service (%s)...", service.Name)
+	service.setState(EnitServiceReloading)
+	defer func() {
+		if service.state == EnitServiceReloading {
+			service.setState(EnitServiceRunning)
+		}
+	}()
+
+	if strings.TrimSpace(service.ReloadCmd) != "" {
+		cmd, err := service.createCommand(service.ReloadCmd)
+		if err != nil {
+			return err
 		}
+		cmd.Env = append(cmd.Env, "MAINPID="+strconv.Itoa(service.processID))
 
 		if err := cmd.Run(); err != nil {
 			return err
 		}
+	} else {
+		if service.processID == 0 {
+			return fmt.Errorf("service has no main process to signal")
+		}
+
+		if err := syscall.Kill(service.processID, service.reloadSignal); err != nil {
+			return err
+		}
 	}
 
-	if service.Type == "background" {
-		// Check if the process has stopped gracefully, otherwise send sigkill on timeout
-		exited := make(chan bool)
-		go func() {
-			for {
-				if err := syscall.Kill(pid, syscall.Signal(0)); err != nil {
-					break
-				}
+	// Wait for notify services to send READY=1 once they have finished reloading
+	if service.Type == "notify" {
+		deadline := time.Now().Add(service.getReadyTimeout())
+		for service.state == EnitServiceReloading {
+			if time.Now().After(deadline) {
+				return fmt.Errorf("service did not send READY=1 in time after reloading")
 			}
-			exited <- true
-		}()
-
-		select {
-		case <-exited:
-		case <-time.After(15 * time.Second):
-			service.GetProcess().Signal(syscall.SIGKILL)
-			return fmt.Errorf("could not stop process gracefully")
+			time.Sleep(50 * time.Millisecond)
+		}
+		if service.state != EnitServiceRunning {
+			return fmt.Errorf("service has stopped while reloading")
 		}
 	}
 
-	newServiceStatus = EnitServiceStopped
-	logger.Printf("Service (%s) has stopped!\n", service.Name)
+	logger.Printf("Service (%s) has been reloaded!\n", service.Name)
 
 	return nil
 }
 
+// Get the time to wait for the service to become ready after starting it
+func (service *EnitService) getReadyTimeout() time.Duration {
+	if service.ReadyTimeout == 0 {
+		return 10 * time.Second
+	}
+
+	return time.Duration(service.ReadyTimeout) * time.Second
+}
+
+// Get the time to wait for service processes to exit after stopping it
+func (service *EnitService) getStopTimeout() time.Duration {
+	if service.StopTimeout == 0 {
+		return 15 * time.Second
+	}
+
+	return time.Duration(service.StopTimeout) * time.Second
+}
+
 func (service *EnitService) RestartService() error {
 	if err := service.StopService(); err != nil {
 		return err
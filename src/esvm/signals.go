@@ -0,0 +1,48 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// Parse a signal given by name with or without the "SIG" prefix, or by number
+func parseSignal(value string) (syscall.Signal, error) {
+	value = strings.ToUpper(strings.TrimSpace(value))
+
+	if number, err := strconv.Atoi(value); err == nil {
+		if unix.SignalName(syscall.Signal(number)) == "" {
+			return 0, fmt.Errorf("unknown signal (%s)", value)
+		}
+		return syscall.Signal(number), nil
+	}
+
+	if !strings.HasPrefix(value, "SIG") {
+		value = "SIG" + value
+	}
+	signal := unix.SignalNum(value)
+	if signal == 0 {
+		return 0, fmt.Errorf("unknown signal (%s)", value)
+	}
+
+	return signal, nil
+}
+
+// Send a signal to all processes of the service
+func (service *EnitService) signalProcesses(pid int, signal syscall.Signal) error {
+	if service.hasCgroup() {
+		service.signalCgroup(signal)
+		return nil
+	} else if pid == 0 {
+		return fmt.Errorf("service has no process")
+	}
+
+	// Signal the process group, or only the process if it has no process group of its own
+	if err := syscall.Kill(-pid, signal); err == nil {
+		return nil
+	}
+	return syscall.Kill(pid, signal)
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"syscall"
+	"testing"
+)
+
+func TestParseSignal(t *testing.T) {
+	tests := []struct {
+		value string
+		want  syscall.Signal
+	}{
+		{"SIGTERM", syscall.SIGTERM},
+		{"TERM", syscall.SIGTERM},
+		{"sigterm", syscall.SIGTERM},
+		{" hup ", syscall.SIGHUP},
+		{"SIGUSR1", syscall.SIGUSR1},
+		{"KILL", syscall.SIGKILL},
+		{"9", syscall.SIGKILL},
+		{"15", syscall.SIGTERM},
+	}
+
+	for _, test := range tests {
+		got, err := parseSignal(test.value)
+		if err != nil {
+			t.Errorf("parseSignal(%q) returned error: %s", test.value, err)
+			continue
+		}
+		if got != test.want {
+			t.Errorf("parseSignal(%q) = %d, want %d", test.value, got, test.want)
+		}
+	}
+}
+
+func TestParseSignalInvalid(t *testing.T) {
+	values := []string{
+		"",
+		"SIG",
+		"SIGFOO",
+		"FOO",
+		"SIGSIGTERM",
+		"0",
+		"-1",
+		"1000",
+	}
+
+	for _, value := range values {
+		if _, err := parseSignal(value); err == nil {
+			t.Errorf("parseSignal(%q) did not return an error", value)
+		}
+	}
+}
@@ -1,12 +1,13 @@
 package main
 
 import (
-	"bytes"
 	"encoding/json"
 	"fmt"
-	"io"
 	"net"
+	"os"
 	"path"
+	"runtime/debug"
+	"time"
 )
 
 var commandHandlers = make(map[string]func(conn net.Conn, jsonData map[string]any))
@@ -17,17 +18,36 @@ func initSocket() (socket net.Listener, err error) {
 		return nil, err
 	}
 
+	// Allow all users to connect. Commands are authorized using the socket policy
+	if err := os.Chmod(path.Join(runtimeServiceDir, "esvm.sock"), 0666); err != nil {
+		socket.Close()
+		return nil, err
+	}
+	policy = readSocketPolicy()
+
 	// Register command handlers
 	commandHandlers["reload"] = handleReloadServicesCommand
 	commandHandlers["start"] = handleStartServiceCommand
 	commandHandlers["stop"] = handleStopServiceCommand
 	commandHandlers["restart"] = handleRestartServiceCommand
+	commandHandlers["reset-failed"] = handleResetFailedServiceCommand
+	commandHandlers["reload-service"] = handleReloadServiceCommand
 	commandHandlers["status"] = handleStatusServiceCommand
 	commandHandlers["list"] = handleListServicesCommand
+	commandHandlers["subscribe"] = handleSubscribeCommand
 
 	return socket, nil
 }
 
+// Handle socket connections in the background
+func acceptSocketConnections() {
+	go func() {
+		for {
+			listenToSocket()
+		}
+	}()
+}
+
 func listenToSocket() {
 	conn, err := socket.Accept()
 	if err != nil {
@@ -38,39 +58,41 @@ func listenToSocket() {
 	// Handle the connection in a separate goroutine.
 	go func(conn net.Conn) {
 		defer conn.Close()
+		defer recoverFromPanic()
 
-		// Read data from the connection.
-		data, err := readAllConn(conn)
+		// Get credentials of the client
+		peer, err := getPeerCredentials(conn)
 		if err != nil {
-			logger.Fatalf("Could not read data from socket! Error: %s\n", err)
+			logger.Printf("Error: could not get credentials of socket client: %s\n", err)
 			return
 		}
 
-		// Decoode JSON data
+		// Read first request from the connection
+		decoder := json.NewDecoder(conn)
 		var jsonData map[string]any
-		err = json.Unmarshal(data, &jsonData)
-		if err != nil {
-			conn.Write(wrapErrorInJson(fmt.Errorf("Invalid JSON")))
+		if err := decoder.Decode(&jsonData); err != nil {
+			conn.Write(wrapErrorInJson(newCommandError(errorCodeInvalidRequest, "Invalid JSON")))
 			return
 		}
 
-		// Get command to execute
-		command, ok := jsonData["command"]
-		if !ok {
-			conn.Write(wrapErrorInJson(fmt.Errorf("'command' field missing")))
+		// Use framed protocol if the client starts with a hello command
+		if jsonData["command"] == "hello" {
+			handleFramedConnection(conn, decoder, jsonData, peer)
 			return
 		}
 
-		// Get command handler
-		commandHandler, ok := commandHandlers[command.(string)]
-		if !ok {
-			conn.Write(wrapErrorInJson(fmt.Errorf("command (%s) has not been implemented", command.(string))))
-			return
-		}
-		commandHandler(conn, jsonData)
+		// Handle single request of legacy clients
+		handleRequest(conn, jsonData, peer)
 	}(conn)
 }
 
+// Log panics caused by handling a socket request instead of letting them crash esvm
+func recoverFromPanic() {
+	if r := recover(); r != nil {
+		logger.Printf("Error: panic while handling socket request: %v\n%s", r, debug.Stack())
+	}
+}
+
 func handleReloadServicesCommand(conn net.Conn, jsonData map[string]any) {
 	// Reload services
 	Reload()
@@ -80,88 +102,133 @@ func handleReloadServicesCommand(conn net.Conn, jsonData map[string]any) {
 
 func handleStartServiceCommand(conn net.Conn, jsonData map[string]any) {
 	// Get service name from json data
-	serviceName, ok := jsonData["service"]
+	serviceName, ok := jsonData["service"].(string)
 	if !ok {
-		conn.Write(wrapErrorInJson(fmt.Errorf("'service' field missing")))
+		conn.Write(wrapErrorInJson(newCommandError(errorCodeInvalidRequest, "'service' field missing or invalid")))
 		return
 	}
 
 	// Ensure service exists
-	service := GetServiceByName(serviceName.(string))
+	service := GetOrInstantiateService(serviceName)
 	if service == nil {
-		conn.Write(wrapErrorInJson(fmt.Errorf("Service (%s) not found", serviceName.(string))))
+		conn.Write(wrapErrorInJson(newCommandError(errorCodeNotFound, "Service (%s) not found", serviceName)))
 		return
 	}
 
 	// Start the service
 	if err := service.StartService(); err != nil {
-		conn.Write(wrapErrorInJson(fmt.Errorf("Service (%s) could not be started", serviceName.(string))))
+		conn.Write(wrapErrorInJson(fmt.Errorf("Service (%s) could not be started", serviceName)))
 		return
 	}
 
-	conn.Write(wrapSuccessMsgInJson(fmt.Sprintf("Service (%s) has started sucessfully", serviceName.(string))))
+	conn.Write(wrapSuccessMsgInJson(fmt.Sprintf("Service (%s) has started sucessfully", serviceName)))
 }
 
 func handleStopServiceCommand(conn net.Conn, jsonData map[string]any) {
 	// Get service name from json data
-	serviceName, ok := jsonData["service"]
+	serviceName, ok := jsonData["service"].(string)
 	if !ok {
-		conn.Write(wrapErrorInJson(fmt.Errorf("'service' field missing")))
+		conn.Write(wrapErrorInJson(newCommandError(errorCodeInvalidRequest, "'service' field missing or invalid")))
 		return
 	}
 
 	// Ensure service exists
-	service := GetServiceByName(serviceName.(string))
+	service := GetServiceByName(serviceName)
 	if service == nil {
-		conn.Write(wrapErrorInJson(fmt.Errorf("Service (%s) not found", serviceName.(string))))
+		conn.Write(wrapErrorInJson(newCommandError(errorCodeNotFound, "Service (%s) not found", serviceName)))
 		return
 	}
 
 	// Stop the service
 	if err := service.StopService(); err != nil {
-		conn.Write(wrapErrorInJson(fmt.Errorf("Service (%s) could not be stopped", serviceName.(string))))
+		conn.Write(wrapErrorInJson(fmt.Errorf("Service (%s) could not be stopped", serviceName)))
 		return
 	}
 
-	conn.Write(wrapSuccessMsgInJson(fmt.Sprintf("Service (%s) has stopped sucessfully", serviceName.(string))))
+	conn.Write(wrapSuccessMsgInJson(fmt.Sprintf("Service (%s) has stopped sucessfully", serviceName)))
 }
 
 func handleRestartServiceCommand(conn net.Conn, jsonData map[string]any) {
 	// Get service name from json data
-	serviceName, ok := jsonData["service"]
+	serviceName, ok := jsonData["service"].(string)
 	if !ok {
-		conn.Write(wrapErrorInJson(fmt.Errorf("'service' field missing")))
+		conn.Write(wrapErrorInJson(newCommandError(errorCodeInvalidRequest, "'service' field missing or invalid")))
 		return
 	}
 
 	// Ensure service exists
-	service := GetServiceByName(serviceName.(string))
+	service := GetOrInstantiateService(serviceName)
 	if service == nil {
-		conn.Write(wrapErrorInJson(fmt.Errorf("Service (%s) not found", serviceName.(string))))
+		conn.Write(wrapErrorInJson(newCommandError(errorCodeNotFound, "Service (%s) not found", serviceName)))
 		return
 	}
 
 	// Restart the service
 	if err := service.RestartService(); err != nil {
-		conn.Write(wrapErrorInJson(fmt.Errorf("Service (%s) could not be restarted", serviceName.(string))))
+		conn.Write(wrapErrorInJson(fmt.Errorf("Service (%s) could not be restarted", serviceName)))
+		return
+	}
+
+	conn.Write(wrapSuccessMsgInJson(fmt.Sprintf("Service (%s) has restarted sucessfully", serviceName)))
+}
+
+func handleReloadServiceCommand(conn net.Conn, jsonData map[string]any) {
+	// Get service name from json data
+	serviceName, ok := jsonData["service"].(string)
+	if !ok {
+		conn.Write(wrapErrorInJson(newCommandError(errorCodeInvalidRequest, "'service' field missing or invalid")))
+		return
+	}
+
+	// Ensure service exists
+	service := GetServiceByName(serviceName)
+	if service == nil {
+		conn.Write(wrapErrorInJson(newCommandError(errorCodeNotFound, "Service (%s) not found", serviceName)))
+		return
+	}
+
+	// Reload the service
+	if err := service.ReloadService(); err != nil {
+		conn.Write(wrapErrorInJson(fmt.Errorf("Service (%s) could not be reloaded: %s", serviceName, err)))
 		return
 	}
 
-	conn.Write(wrapSuccessMsgInJson(fmt.Sprintf("Service (%s) has restarted sucessfully", serviceName.(string))))
+	conn.Write(wrapSuccessMsgInJson(fmt.Sprintf("Service (%s) has reloaded sucessfully", serviceName)))
+}
+
+func handleResetFailedServiceCommand(conn net.Conn, jsonData map[string]any) {
+	// Get service name from json data
+	serviceName, ok := jsonData["service"].(string)
+	if !ok {
+		conn.Write(wrapErrorInJson(newCommandError(errorCodeInvalidRequest, "'service' field missing or invalid")))
+		return
+	}
+
+	// Ensure service exists
+	service := GetServiceByName(serviceName)
+	if service == nil {
+		conn.Write(wrapErrorInJson(newCommandError(errorCodeNotFound, "Service (%s) not found", serviceName)))
+		return
+	}
+
+	// Reset the failed state of the service
+	service.ResetFailed()
+
+	conn.Write(wrapSuccessMsgInJson(fmt.Sprintf("Service (%s) has been reset sucessfully", serviceName)))
 }
 
 func handleStatusServiceCommand(conn net.Conn, jsonData map[string]any) {
 	// Get service name from json data
-	serviceName, ok := jsonData["service"]
+	serviceName, ok := jsonData["service"].(string)
 	if !ok {
-		conn.Write(wrapErrorInJson(fmt.Errorf("'service' field missing")))
+		conn.Write(wrapErrorInJson(newCommandError(errorCodeInvalidRequest, "'service' field missing or invalid")))
 		return
 	}
 
 	// Ensure service exists
-	service := GetServiceByName(serviceName.(string))
+	service := GetServiceByName(serviceName)
 	if service == nil {
-		conn.Write(wrapErrorInJson(fmt.Errorf("Service (%s) not found", serviceName.(string))))
+		conn.Write(wrapErrorInJson(newCommandError(errorCodeNotFound, "Service (%s) not found", serviceName)))
 		return
 	}
 
@@ -170,6 +237,36 @@ func handleStatusServiceCommand(conn net.Conn, jsonData map[string]any) {
 	statusMap["description"] = service.Description
 	statusMap["state"] = EnitServiceStateNames[service.state]
 	statusMap["process_id"] = service.processID
+	statusMap["status_text"] = service.statusText
+	statusMap["health"] = service.getHealth()
+	statusMap["last_keepalive"] = ""
+	if service.watchdogStopChannel != nil {
+		statusMap["last_keepalive"] = formatTimestamp(service.getLastKeepalive())
+	}
+	statusMap["failed_hook"] = service.failedHook
+	statusMap["hook_exit_code"] = service.hookExitCode
+	statusMap["restart"] = service.Restart
+	statusMap["restart_count"] = service.restartCount
+	statusMap["limits"] = service.getFormattedRlimits()
+	statusMap["cgroup"] = ""
+	statusMap["cgroup_limits"] = service.getConfiguredCgroupLimits()
+	statusMap["processes"] = make([]int, 0)
+	if service.hasCgroup() {
+		statusMap["cgroup"] = service.getCgroupName()
+		statusMap["processes"] = service.getCgroupProcesses()
+	}
+	statusMap["next_elapse"] = formatTimestamp(service.nextElapse)
+	statusMap["last_triggered"] = formatTimestamp(service.lastTriggered)
+	statusMap["sockets"] = make([]string, 0)
+	for _, socket := range service.Sockets {
+		statusMap["sockets"] = append(statusMap["sockets"].([]string), socket.Type+":"+socket.getAddress())
+	}
+	statusMap["requires"] = service.Requires
+	statusMap["wants"] = service.Wants
+	statusMap["required_by"] = make([]string, 0)
+	for _, sv := range service.getRequiredBy() {
+		statusMap["required_by"] = append(statusMap["required_by"].([]string), sv.Name)
+	}
 
 	// Encode map to json string
 	newJsonData, err := json.Marshal(statusMap)
@@ -186,12 +283,13 @@ func handleListServicesCommand(conn net.Conn, _ map[string]any) {
 	servicesMap["services"] = make([]map[string]any, 0)
 
 	// Loop through each service
-	for _, service := range Services {
+	for _, service := range getServices() {
 		statusMap := make(map[string]any)
 		statusMap["name"] = service.Name
 		statusMap["description"] = service.Description
 		statusMap["state"] = EnitServiceStateNames[service.state]
 		statusMap["process_id"] = service.processID
+		statusMap["next_elapse"] = formatTimestamp(service.nextElapse)
 		servicesMap["services"] = append(servicesMap["services"].([]map[string]any), statusMap)
 	}
 
@@ -209,9 +307,11 @@ func wrapErrorInJson(err error) []byte {
 	// Wrap error in struct
 	type jsonErrorStruct struct {
 		Error string `json:"error"`
+		Code  string `json:"code"`
 	}
 	jsonError := jsonErrorStruct{
 		Error: err.Error(),
+		Code:  getErrorCode(err),
 	}
 
 	// Encode struct to json string
@@ -239,23 +339,11 @@ func wrapSuccessMsgInJson(msg string) []byte {
 	return jsonData
 }
 
-func readAllConn(conn net.Conn) ([]byte, error) {
-	var buf bytes.Buffer
-
-	for {
-		dataChunk := make([]byte, 1024)
-
-		n, err := conn.Read(dataChunk)
-		if err != nil && err != io.EOF {
-			return nil, err
-		}
-
-		buf.Write(dataChunk[:n])
-
-		if n < 1024 {
-			break
-		}
+// Format a timestamp for JSON output. Zero times are returned as an empty string
+func formatTimestamp(t time.Time) string {
+	if t.IsZero() {
+		return ""
 	}
 
-	return buf.Bytes(), nil
+	return t.Format(time.RFC3339)
 }
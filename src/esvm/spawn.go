@@ -0,0 +1,151 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"runtime"
+	"strings"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// Esvm runs itself with this argument to setup the service process before executing the service command
+const spawnHelperArg = "__spawn-service"
+const spawnConfigEnv = "ESVM_SPAWN_CONFIG"
+
+type spawnConfig struct {
+	Command          string                 `json:"command"`
+	Rlimits          map[int]syscall.Rlimit `json:"rlimits,omitempty"`
+	RootDirectory    string                 `json:"root_directory,omitempty"`
+	WorkingDirectory string                 `json:"working_directory,omitempty"`
+	Umask            int                    `json:"umask"`
+	Credential       *syscall.Credential    `json:"credential,omitempty"`
+	Sandbox          *sandboxConfig         `json:"sandbox,omitempty"`
+	Capabilities     uint64                 `json:"capabilities,omitempty"`
+	BoundingSet      *uint64                `json:"bounding_set,omitempty"`
+	SandboxPID       int                    `json:"sandbox_pid,omitempty"`
+	HoldSandbox      bool                   `json:"hold_sandbox,omitempty"`
+}
+
+// Setup the current process using the config passed by esvm and execute the service command. Never returns
+func runSpawnHelper() {
+	runtime.LockOSThread()
+
+	fail := func(format string, v ...any) {
+		fmt.Fprintf(os.Stderr, "esvm: could not spawn service: "+format+"\n", v...)
+		os.Exit(127)
+	}
+
+	// Read spawn config and remove it from the environment
+	var config spawnConfig
+	if err := json.Unmarshal([]byte(os.Getenv(spawnConfigEnv)), &config); err != nil {
+		fail("invalid spawn config: %s", err)
+	}
+	env := make([]string, 0)
+	for _, variable := range os.Environ() {
+		if !strings.HasPrefix(variable, spawnConfigEnv+"=") {
+			env = append(env, variable)
+		}
+	}
+
+	// Set resource limits
+	for resource, rlimit := range config.Rlimits {
+		if err := syscall.Setrlimit(resource, &rlimit); err != nil {
+			fail("could not set resource limit %d: %s", resource, err)
+		}
+	}
+
+	// Setup sandbox or join the sandbox of the service
+	if config.SandboxPID != 0 {
+		if err := joinSandbox(config.SandboxPID, config.Sandbox); err != nil {
+			fail("could not join sandbox: %s", err)
+		}
+	} else if config.Sandbox != nil {
+		if err := setupSandbox(config.Sandbox); err != nil {
+			fail("could not setup sandbox: %s", err)
+		}
+	}
+
+	// Keep the sandbox namespaces alive until esvm kills this process
+	if config.HoldSandbox {
+		os.Stdout.Write([]byte("ready\n"))
+		os.Stdout.Close()
+		for {
+			unix.Pause()
+		}
+	}
+
+	// Change root directory
+	if config.RootDirectory != "" {
+		if err := syscall.Chroot(config.RootDirectory); err != nil {
+			fail("could not change root directory: %s", err)
+		}
+		if err := syscall.Chdir("/"); err != nil {
+			fail("could not change working directory: %s", err)
+		}
+	}
+
+	// Change working directory
+	if config.WorkingDirectory != "" {
+		if err := syscall.Chdir(config.WorkingDirectory); err != nil {
+			fail("could not change working directory: %s", err)
+		}
+	}
+
+	// Set umask
+	if config.Umask >= 0 {
+		syscall.Umask(config.Umask)
+	}
+
+	// Limit capability bounding set
+	if config.BoundingSet != nil {
+		if err := setCapabilityBoundingSet(*config.BoundingSet); err != nil {
+			fail("could not set capability bounding set: %s", err)
+		}
+	}
+
+	// Keep permitted capabilities when switching to a non-root user
+	dropsRoot := config.Credential != nil && config.Credential.Uid != 0
+	if config.Capabilities != 0 && dropsRoot {
+		if err := unix.Prctl(unix.PR_SET_KEEPCAPS, 1, 0, 0, 0); err != nil {
+			fail("could not keep capabilities: %s", err)
+		}
+	}
+
+	// Drop privileges
+	if config.Credential != nil {
+		groups := make([]int, 0, len(config.Credential.Groups))
+		for _, group := range config.Credential.Groups {
+			groups = append(groups, int(group))
+		}
+
+		if err := syscall.Setgroups(groups); err != nil {
+			fail("could not set supplementary groups: %s", err)
+		}
+		if err := syscall.Setgid(int(config.Credential.Gid)); err != nil {
+			fail("could not set group id: %s", err)
+		}
+		if err := syscall.Setuid(int(config.Credential.Uid)); err != nil {
+			fail("could not set user id: %s", err)
+		}
+	}
+
+	// Grant ambient capabilities
+	if config.Capabilities != 0 {
+		if err := setAmbientCapabilities(config.Capabilities, dropsRoot); err != nil {
+			fail("could not set capabilities: %s", err)
+		}
+	}
+
+	// Prevent command from gaining new privileges
+	if config.Sandbox != nil && config.Sandbox.NoNewPrivileges {
+		if err := unix.Prctl(unix.PR_SET_NO_NEW_PRIVS, 1, 0, 0, 0); err != nil {
+			fail("could not set no_new_privileges: %s", err)
+		}
+	}
+
+	err := syscall.Exec("/bin/sh", []string{"/bin/sh", "-c", config.Command}, env)
+	fail("could not execute command: %s", err)
+}
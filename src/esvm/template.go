@@ -0,0 +1,81 @@
+package main
+
+import (
+	"os"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+var validInstanceName = regexp.MustCompile(`^[A-Za-z0-9:_.\\-]+$`)
+
+// Check whether the service file is a template like agetty@.esv
+func isTemplateFile(filepath string) bool {
+	return strings.HasSuffix(path.Base(filepath), "@.esv")
+}
+
+// Get the name of the service instance created from a template file
+func getInstanceName(filepath, instance string) string {
+	return strings.TrimSuffix(path.Base(filepath), ".esv") + instance
+}
+
+// Replace the %i and %I specifiers in a template with the instance name
+func expandTemplate(data []byte, instance string) []byte {
+	replacer := strings.NewReplacer("%%", "%", "%i", instance, "%I", unescapeInstanceName(instance))
+	return []byte(replacer.Replace(string(data)))
+}
+
+// Unescape an instance name by replacing '-' with '/' and \xNN sequences with the byte they encode
+func unescapeInstanceName(instance string) string {
+	var builder strings.Builder
+	for i := 0; i < len(instance); i++ {
+		switch {
+		case instance[i] == '-':
+			builder.WriteByte('/')
+		case instance[i] == '\\' && i+3 < len(instance) && instance[i+1] == 'x':
+			if b, err := strconv.ParseUint(instance[i+2:i+4], 16, 8); err == nil {
+				builder.WriteByte(byte(b))
+				i += 3
+				continue
+			}
+			builder.WriteByte(instance[i])
+		default:
+			builder.WriteByte(instance[i])
+		}
+	}
+
+	return builder.String()
+}
+
+// Get a service by name, loading it from its template if it is an instance of a templated service that has not been
+// loaded yet. Must only be used before starting the service, so that lookups do not load instances that are never used
+func GetOrInstantiateService(name string) *EnitService {
+	if service := GetServiceByName(name); service != nil {
+		return service
+	}
+
+	return instantiateService(name)
+}
+
+// Load an instance of a templated service from its template file. Returns nil if there is no matching template
+func instantiateService(name string) *EnitService {
+	prefix, instance, ok := strings.Cut(name, "@")
+	if !ok || prefix == "" || !validInstanceName.MatchString(instance) {
+		return nil
+	}
+
+	filepath := path.Join(serviceConfigDir, "services", prefix+"@.esv")
+	if _, err := os.Stat(filepath); err != nil {
+		return nil
+	}
+
+	LoadService(filepath, instance)
+	for _, service := range getServices() {
+		if service.Name == name {
+			return service
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,47 @@
+package main
+
+import "testing"
+
+func TestUnescapeInstanceName(t *testing.T) {
+	tests := []struct {
+		instance string
+		want     string
+	}{
+		{"tty1", "tty1"},
+		{"dev-sda1", "dev/sda1"},
+		{"-home-user", "/home/user"},
+		{`my\x20disk`, "my disk"},
+		{`a\x2db`, "a-b"},
+		{`\x41`, "A"},
+		{`\x4`, `\x4`},
+		{`\xzz`, `\xzz`},
+		{`end\`, `end\`},
+	}
+
+	for _, test := range tests {
+		if got := unescapeInstanceName(test.instance); got != test.want {
+			t.Errorf("unescapeInstanceName(%q) = %q, want %q", test.instance, got, test.want)
+		}
+	}
+}
+
+func TestExpandTemplate(t *testing.T) {
+	tests := []struct {
+		data     string
+		instance string
+		want     string
+	}{
+		{"name: agetty@%i", "tty1", "name: agetty@tty1"},
+		{"start_cmd: fsck %I", "dev-sda1", "start_cmd: fsck dev/sda1"},
+		{"%i %I", `mnt-my\x20disk`, `mnt-my\x20disk mnt/my disk`},
+		{"100%% %i", "x", "100% x"},
+		{"%%i", "x", "%i"},
+		{"no specifiers", "x", "no specifiers"},
+	}
+
+	for _, test := range tests {
+		if got := string(expandTemplate([]byte(test.data), test.instance)); got != test.want {
+			t.Errorf("expandTemplate(%q, %q) = %q, want %q", test.data, test.instance, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const timerStateDir = "/var/lib/esvm/timers"
+
+type EnitServiceTimer struct {
+	OnBootSec   int    `yaml:"on_boot_sec,omitempty"`
+	OnActiveSec int    `yaml:"on_active_sec,omitempty"`
+	IntervalSec int    `yaml:"interval_sec,omitempty"`
+	OnCalendar  string `yaml:"on_calendar,omitempty"`
+	Persistent  bool   `yaml:"persistent,omitempty"`
+}
+
+// Check whether the timer definition is valid and parse its calendar expression
+func (timer *EnitServiceTimer) parse() (*calendarSpec, error) {
+	if timer.OnBootSec < 0 || timer.OnActiveSec < 0 || timer.IntervalSec < 0 {
+		return nil, fmt.Errorf("timer values cannot be negative")
+	}
+
+	if timer.OnBootSec == 0 && timer.OnActiveSec == 0 && timer.IntervalSec == 0 && timer.OnCalendar == "" {
+		return nil, fmt.Errorf("timer has no elapse time set")
+	}
+
+	if timer.OnCalendar == "" {
+		return nil, nil
+	}
+
+	return parseCalendarSpec(timer.OnCalendar)
+}
+
+// Get the time the system was booted at
+func getBootTime() time.Time {
+	data, err := os.ReadFile("/proc/uptime")
+	if err != nil {
+		return time.Now()
+	}
+
+	uptime, err := strconv.ParseFloat(strings.Fields(string(data))[0], 64)
+	if err != nil {
+		return time.Now()
+	}
+
+	return time.Now().Add(-time.Duration(uptime * float64(time.Second)))
+}
+
+// Read the time the timer of the service was last triggered at
+func (service *EnitService) readTimerTimestamp() time.Time {
+	data, err := os.ReadFile(path.Join(timerStateDir, service.Name))
+	if err != nil {
+		return time.Time{}
+	}
+
+	timestamp, err := time.Parse(time.RFC3339, strings.TrimSpace(string(data)))
+	if err != nil {
+		return time.Time{}
+	}
+
+	return timestamp
+}
+
+// Save the time the timer of the service was last triggered at
+func (service *EnitService) writeTimerTimestamp(timestamp time.Time) error {
+	err := os.MkdirAll(timerStateDir, 0755)
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(path.Join(timerStateDir, service.Name), []byte(timestamp.Format(time.RFC3339)+"\n"), 0644)
+}
+
+// Get the next time the timer of the service should elapse at. Returns a zero time if it will never elapse again
+func (service *EnitService) getNextTimerElapse(armedAt time.Time, bootElapsed, activeElapsed bool) time.Time {
+	candidates := make([]time.Time, 0)
+
+	if service.Timer.OnBootSec > 0 && !bootElapsed {
+		candidates = append(candidates, getBootTime().Add(time.Duration(service.Timer.OnBootSec)*time.Second))
+	}
+
+	if service.Timer.OnActiveSec > 0 && !activeElapsed {
+		candidates = append(candidates, armedAt.Add(time.Duration(service.Timer.OnActiveSec)*time.Second))
+	}
+
+	if service.Timer.IntervalSec > 0 {
+		lastTriggered := service.lastTriggered
+		if lastTriggered.IsZero() {
+			lastTriggered = armedAt
+		}
+		candidates = append(candidates, lastTriggered.Add(time.Duration(service.Timer.IntervalSec)*time.Second))
+	}
+
+	if service.timerCalendar != nil {
+		// Elapse immediately if a persistent timer missed an elapse
+		from := time.Now()
+		if service.Timer.Persistent && !service.lastTriggered.IsZero() {
+			from = service.lastTriggered
+		}
+
+		if next := service.timerCalendar.next(from); !next.IsZero() {
+			candidates = append(candidates, next)
+		}
+	}
+
+	nextElapse := time.Time{}
+	for _, candidate := range candidates {
+		if nextElapse.IsZero() || candidate.Before(nextElapse) {
+			nextElapse = candidate
+		}
+	}
+
+	return nextElapse
+}
+
+// Start the service each time its timer elapses
+func (service *EnitService) armTimer() error {
+	logger.Printf("Starting timer for service (%s)...\n", service.Name)
+
+	stopChannel := make(chan bool)
+	service.timerStopChannel = stopChannel
+	if service.Timer.Persistent {
+		service.lastTriggered = service.readTimerTimestamp()
+	}
+	service.setState(EnitServiceWaiting)
+
+	go func() {
+		armedAt := time.Now()
+		bootElapsed, activeElapsed := false, false
+
+		for {
+			nextElapse := service.getNextTimerElapse(armedAt, bootElapsed, activeElapsed)
+			service.nextElapse = nextElapse
+			if nextElapse.IsZero() {
+				logger.Printf("Timer for service (%s) will not elapse again\n", service.Name)
+				return
+			}
+
+			select {
+			case <-stopChannel:
+				service.nextElapse = time.Time{}
+				return
+			case <-time.After(time.Until(nextElapse)):
+			}
+
+			// Mark monotonic elapses as done
+			now := time.Now()
+			if service.Timer.OnBootSec > 0 && !getBootTime().Add(time.Duration(service.Timer.OnBootSec)*time.Second).After(now) {
+				bootElapsed = true
+			}
+			if service.Timer.OnActiveSec > 0 && !armedAt.Add(time.Duration(service.Timer.OnActiveSec)*time.Second).After(now) {
+				activeElapsed = true
+			}
+
+			// Save trigger time
+			service.lastTriggered = now
+			if err := service.writeTimerTimestamp(now); err != nil {
+				logger.Printf("Warning: could not save timer timestamp for service (%s): %s\n", service.Name, err)
+			}
+
+			logger.Printf("Timer for service (%s) has elapsed\n", service.Name)
+			if err := service.StartService(); err != nil {
+				logger.Printf("Error: could not start service (%s): %s", service.Name, err)
+			}
+		}
+	}()
+
+	// Add to started services order slice
+	addToStartedServicesOrder(service.Name)
+
+	logger.Printf("Timer for service (%s) has started!\n", service.Name)
+
+	return nil
+}
+
+// Stop the timer of the service
+func (service *EnitService) disarmTimer() {
+	if service.timerStopChannel == nil {
+		return
+	}
+
+	close(service.timerStopChannel)
+	service.timerStopChannel = nil
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"os"
+	"path"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+// Get the path of the file the service can touch to send watchdog keepalives
+func (service *EnitService) getWatchdogFilePath() string {
+	return path.Join(runtimeServiceDir, "watchdog", service.Name)
+}
+
+// Create the watchdog keepalive file and get the environment variables for the watchdog
+func (service *EnitService) setupWatchdog() ([]string, error) {
+	err := os.MkdirAll(path.Join(runtimeServiceDir, "watchdog"), 0755)
+	if err != nil {
+		return nil, err
+	}
+
+	err = os.WriteFile(service.getWatchdogFilePath(), nil, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	// Allow the service user to touch the file
+	if credential, err := service.getCredential(); err != nil {
+		return nil, err
+	} else if credential != nil {
+		if err := os.Chown(service.getWatchdogFilePath(), int(credential.Uid), int(credential.Gid)); err != nil {
+			return nil, err
+		}
+	}
+
+	env := []string{
+		"WATCHDOG_USEC=" + strconv.FormatInt(int64(service.WatchdogSec)*1000000, 10),
+		"WATCHDOG_FILE=" + service.getWatchdogFilePath(),
+	}
+
+	return env, nil
+}
+
+// Get the time the last watchdog keepalive was received at, either through the notify socket or the keepalive file
+func (service *EnitService) getLastKeepalive() time.Time {
+	lastKeepalive := service.lastWatchdogPing
+	if stat, err := os.Stat(service.getWatchdogFilePath()); err == nil && stat.ModTime().After(lastKeepalive) {
+		lastKeepalive = stat.ModTime()
+	}
+
+	return lastKeepalive
+}
+
+// Abort the service if it does not send a watchdog keepalive in time
+func (service *EnitService) startWatchdog() {
+	if service.WatchdogSec <= 0 || service.watchdogStopChannel != nil {
+		return
+	}
+
+	stopChannel := make(chan bool)
+	service.watchdogStopChannel = stopChannel
+	service.lastWatchdogPing = time.Now()
+	timeout := time.Duration(service.WatchdogSec) * time.Second
+
+	go func() {
+		for {
+			select {
+			case <-stopChannel:
+				return
+			case <-time.After(timeout / 4):
+			}
+
+			// Skip watchdog checks while the service is reloading or stopping
+			if service.state != EnitServiceRunning || time.Since(service.getLastKeepalive()) < timeout {
+				continue
+			}
+
+			logger.Printf("Service (%s) did not send a watchdog keepalive in time, aborting it\n", service.Name)
+			pid := service.processID
+			if pid == 0 {
+				return
+			}
+
+			syscall.Kill(pid, syscall.SIGABRT)
+			if !service.waitForExit(pid, service.getStopTimeout()) {
+				service.signalProcesses(pid, service.killSignal)
+			}
+			return
+		}
+	}()
+}
+
+func (service *EnitService) stopWatchdog() {
+	if service.watchdogStopChannel == nil {
+		return
+	}
+
+	close(service.watchdogStopChannel)
+	service.watchdogStopChannel = nil
+	os.Remove(service.getWatchdogFilePath())
+}